@@ -1,177 +1,174 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
-	"io/fs"
 	"os"
-	"path/filepath"
-	"runtime"
-	"sync"
+	"os/signal"
+	"os/user"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
 	"time"
 
 	"github.com/makew0rld/merkdir/merkle"
-	"github.com/schollz/progressbar/v3"
+	"github.com/makew0rld/merkdir/tree"
 	"github.com/urfave/cli/v2"
 )
 
-// pbReader updates the progress bar for each read
-type pbReader struct {
-	bar *progressbar.ProgressBar
-	r   io.Reader
-}
+func gen(ctx *cli.Context) error {
+	sigCtx, stop := interruptContext(ctx)
+	defer stop()
 
-func (pbr *pbReader) Read(p []byte) (n int, err error) {
-	n, err = pbr.r.Read(p)
-	if err == nil {
-		err = pbr.bar.Add(n)
+	opts, err := hashOptions(ctx)
+	if err != nil {
+		return err
 	}
-	return
-}
+	opts.Paths = ctx.Args().Slice()
+	if ctx.IsSet("from-tar") {
+		opts.Archive, opts.ArchiveFormat = ctx.String("from-tar"), tree.ArchiveTar
+	} else if ctx.IsSet("from-zip") {
+		opts.Archive, opts.ArchiveFormat = ctx.String("from-zip"), tree.ArchiveZip
+	}
+	opts.Include = ctx.StringSlice("include")
+	opts.Exclude = ctx.StringSlice("exclude")
+	opts.Symlinks = ctx.String("symlinks")
+	opts.ExpandArchives = ctx.Bool("expand-archives")
+	opts.Dirs = ctx.Bool("dirs")
+	opts.NoDigests = ctx.Bool("no-digests")
+	opts.Checkpoint = ctx.String("checkpoint")
+	opts.Resume = ctx.Bool("resume")
+	t, err := tree.Generate(sigCtx, opts)
+	if err != nil {
+		endProgress(opts.Progress)
+		if errors.Is(err, context.Canceled) {
+			if len(ctx.String("checkpoint")) > 0 {
+				return errors.New("interrupted, no tree was written. Use --resume to continue")
+			}
+			return errors.New("interrupted, no tree was written")
+		}
+		return err
+	}
+	fmt.Printf("Root hash: %x\n", t.Root.Hash)
 
-func gen(ctx *cli.Context) error {
-	dirPath := ctx.Args().First()
+	if err := writeTree(ctx, t); err != nil {
+		return err
+	}
+	if len(ctx.String("checkpoint")) > 0 {
+		return os.Remove(ctx.String("checkpoint"))
+	}
+	return nil
+}
 
-	leaves := make([]*merkle.Node, 0)
-	files := make(map[string]uint64, 0)
-	dirFS := os.DirFS(dirPath)
-	startTime := time.Now().UTC()
+func update(ctx *cli.Context) error {
+	sigCtx, stop := interruptContext(ctx)
+	defer stop()
 
-	fmt.Println("Finding files...")
-	filePaths := make([]string, 0)
-	var totalSize int64
-	err := fs.WalkDir(dirFS, ".", func(path string, d fs.DirEntry, err error) error {
-		if err != nil {
-			return err
-		}
-		if d.IsDir() {
-			return nil
-		}
-		if d.Type() != 0 {
-			// Some sort of special file
-			fmt.Printf("Ignoring special file: %s\n", path)
-			return nil
+	old, err := tree.ReadFile(ctx.String("tree"))
+	if err != nil {
+		return fmt.Errorf("error reading or decoding file: %w", err)
+	}
+	opts, err := hashOptions(ctx)
+	if err != nil {
+		return err
+	}
+	t, err := tree.Update(sigCtx, old, opts)
+	if err != nil {
+		endProgress(opts.Progress)
+		if errors.Is(err, context.Canceled) {
+			return errors.New("interrupted, no tree was written")
 		}
-		fi, err := d.Info()
+		return err
+	}
+
+	if old.HasDigests() {
+		d, err := tree.Compare(old, t)
 		if err != nil {
 			return err
 		}
-		totalSize += fi.Size()
-		filePaths = append(filePaths, path)
-		return nil
-	})
-	if err != nil {
-		return err
+		printDiff(d)
 	}
+	fmt.Printf("Root hash: %x\n", t.Root.Hash)
+	return writeTree(ctx, t)
+}
 
-	fmt.Printf("Found %d files. Starting hashing...\n", len(filePaths))
-	bar := progressbar.DefaultBytes(totalSize, "")
-
-	// Have a number of workers go through the files and hash them
-	var wg sync.WaitGroup
-	errCh := make(chan error)
-	leafCh := make(chan *merkle.Node)
-	pathCh := make(chan string)
-	// 2*numCPU workers is just a handpicked number.
-	// It seems to work better than just # of CPUs since this is more I/O-bound
-	// than CPU-bound since blake3 is so fast.
-	for i := 0; i < runtime.NumCPU()*2; i++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-
-			for path := range pathCh {
-				f, err := os.Open(filepath.Join(dirPath, path))
-				if err != nil {
-					errCh <- err
-					return
-				}
-				// Close f manually so that files aren't left open while the loop runs
-				// Otherwise the max open file limit will be hit for large dirs on at
-				// least some OSes like macOS.
-
-				leaf, err := merkle.CreateLeaf(path, &pbReader{bar, f}, nil)
-				f.Close()
-				if err != nil {
-					errCh <- err
-					return
-				}
-				leafCh <- leaf
-			}
-		}()
-	}
-	// Assign work
-	go func() {
-		for _, path := range filePaths {
-			pathCh <- path
-		}
-		close(pathCh)
-	}()
-	// Signal when all are done with no errors
+// interruptContext returns a context that is done on the first Ctrl-C, so
+// hashing can stop cleanly. A second one kills the process.
+func interruptContext(ctx *cli.Context) (context.Context, context.CancelFunc) {
+	sigCtx, stop := signal.NotifyContext(ctx.Context, os.Interrupt)
 	go func() {
-		wg.Wait()
-		errCh <- nil
+		<-sigCtx.Done()
+		stop()
 	}()
+	return sigCtx, stop
+}
 
-outer:
-	for {
-		select {
-		case err := <-errCh:
-			if err == nil {
-				// All workers done without errors
-				break outer
-			} else {
-				return err
-			}
-		case leaf := <-leafCh:
-			// Add leaf to pre-tree
-			files[leaf.Name] = uint64(len(leaves))
-			leaves = append(leaves, leaf)
-		}
-	}
-
-	absPath, err := filepath.Abs(dirPath)
+// hashOptions returns the options set by the flags from hashFlags.
+func hashOptions(ctx *cli.Context) (*tree.GenOptions, error) {
+	bufferSize, err := parseSize(ctx.String("buffer-size"))
 	if err != nil {
-		return err
+		return nil, err
 	}
-	merkTree := tree{
-		Path:      absPath,
-		Files:     files,
-		Root:      merkle.CreateTree(leaves),
-		CreatedAt: startTime,
+	parallelSize, err := parseSize(ctx.String("parallel-size"))
+	if err != nil {
+		return nil, err
 	}
-	fmt.Printf("Root hash: %x\n", merkTree.Root.Hash)
-
-	return writeTree(&merkTree, ctx.String("output"))
+	progress, log := newProgress(ctx.String("progress"))
+	return &tree.GenOptions{
+		OnError:      ctx.String("on-error"),
+		Jobs:         ctx.Int("jobs"),
+		DeviceJobs:   ctx.Int("device-jobs"),
+		BufferSize:   bufferSize,
+		ParallelSize: int64(parallelSize),
+		Generator:    genInfo(),
+		Progress:     progress,
+		Log:          log,
+	}, nil
 }
 
 func root(ctx *cli.Context) error {
-	t, err := readTree(ctx.Args().First())
+	t, err := tree.ReadFile(ctx.Args().First())
 	if err != nil {
 		return fmt.Errorf("error reading or decoding file: %w", err)
 	}
+	node := t.Root
+	if len(ctx.String("dir")) > 0 {
+		if t.Mode != tree.ModeDirs {
+			return fmt.Errorf("only hierarchical trees have directory roots")
+		}
+		node, err = t.Node(path.Clean(ctx.String("dir")))
+		if err != nil {
+			return err
+		}
+	}
 	if ctx.Bool("hex") {
-		fmt.Printf("%x\n", t.Root.Hash)
+		fmt.Printf("%x\n", node.Hash)
 	} else {
-		os.Stdout.Write(t.Root.Hash)
+		os.Stdout.Write(node.Hash)
 	}
 	return nil
 }
 
 func inclusion(ctx *cli.Context) error {
-	t, err := readTree(ctx.String("tree"))
+	t, err := tree.ReadFile(ctx.String("tree"))
 	if err != nil {
 		return fmt.Errorf("error reading or decoding file: %w", err)
 	}
 
-	proof, err := genInclusionProof(t, ctx.String("file"))
+	proof, err := t.InclusionProof(path.Clean(ctx.String("file")), path.Clean(ctx.String("relative-to")))
 	if err != nil {
 		return err
 	}
 	if len(ctx.String("output")) > 0 {
-		return writeInclusionProof(proof, ctx.String("output"))
+		return tree.WriteProofFile(proof, ctx.String("output"))
 	}
 	// Text version of inclusion proof
 	// fmt.Println("== Text explanation of inclusion proof ==")
@@ -181,39 +178,43 @@ func inclusion(ctx *cli.Context) error {
 	// fmt.Printf("File nonce: %x\n", proof.Nonce)
 	// fmt.Println("Operations to calculate that root hash:")
 	// fmt.Println("digest = hash(0x00 || nonce || file data)")
-	fmt.Println("Text explanation of inclusion proof is not implemented.",
+	fmt.Fprintln(os.Stderr, "Text explanation of inclusion proof is not implemented.",
 		"Use --output/-o to store the binary proof instead.")
 	return nil
 }
 
-func verifyFile(ctx *cli.Context) error {
-	// This function assumes the stored tree is valid.
-	// So it only checks that the file hash matches the one stored in the tree
-	// (plus nonce etc.), not that the hash can be traced back to the root.
-
-	t, err := readTree(ctx.String("tree"))
+func extract(ctx *cli.Context) error {
+	t, err := tree.ReadFile(ctx.String("tree"))
 	if err != nil {
 		return fmt.Errorf("error reading or decoding file: %w", err)
 	}
-	name := ctx.String("name")
-	leafN, ok := t.Files[name]
-	if !ok {
-		return fmt.Errorf("file with that name not found in Merkle tree")
-	}
-	leaf, err := merkle.GetLeaf(t.Root, uint64(len(t.Files)), leafN)
+	ext, err := t.Extract(path.Clean(ctx.String("dir")))
 	if err != nil {
-		return fmt.Errorf("error finding leaf in tree: %w", err)
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Extracted %d files\n", len(ext.Files))
+	fmt.Printf("Root hash: %x\n", ext.Root.Hash)
+	return writeTree(ctx, ext)
+}
+
+// writeTree saves a tree to the output file, respecting --no-clobber.
+func writeTree(ctx *cli.Context, t *tree.Tree) error {
+	if ctx.Bool("no-clobber") {
+		return tree.WriteNewFile(t, ctx.String("output"))
 	}
-	f, err := os.Open(filepath.Join(t.Path, name))
+	return tree.WriteFile(t, ctx.String("output"))
+}
+
+func verifyFile(ctx *cli.Context) error {
+	t, err := tree.ReadFile(ctx.String("tree"))
 	if err != nil {
-		return err
+		return fmt.Errorf("error reading or decoding file: %w", err)
 	}
-	defer f.Close()
-	hash, err := merkle.HashLeaf(f, leaf.Nonce)
+	ok, err := t.VerifyFile(ctx.String("name"))
 	if err != nil {
 		return err
 	}
-	if bytes.Equal(hash, leaf.Hash) {
+	if ok {
 		fmt.Println("OK: file is still verified by this Merkle tree")
 		return nil
 	}
@@ -221,19 +222,60 @@ func verifyFile(ctx *cli.Context) error {
 	return nil
 }
 
-func verifyInclusion(ctx *cli.Context) error {
-	ip, err := readInclusionProof(ctx.String("proof"))
+func verifyDir(ctx *cli.Context) error {
+	t, err := tree.ReadFile(ctx.String("tree"))
 	if err != nil {
 		return fmt.Errorf("error reading or decoding file: %w", err)
 	}
-	f, err := os.Open(ctx.String("file"))
+	report, err := t.VerifyDir(ctx.Args().First())
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	rootHash, err := merkle.CalcInclusionProof(ip, f)
+	for _, name := range report.New {
+		fmt.Printf("New: %s\n", name)
+	}
+	for _, name := range report.Changed {
+		fmt.Printf("Changed: %s\n", name)
+	}
+	for _, name := range report.Missing {
+		fmt.Printf("Missing: %s\n", name)
+	}
+
+	if report.OK() {
+		fmt.Println("OK: directory is still verified by this Merkle tree")
+		return nil
+	}
+	fmt.Printf("NOT OK: %d changed, %d new, %d missing files\n",
+		len(report.Changed), len(report.New), len(report.Missing))
+	return nil
+}
+
+func verifyInclusion(ctx *cli.Context) error {
+	ip, err := tree.ReadProofFile(ctx.String("proof"))
 	if err != nil {
-		return fmt.Errorf("unexpected verification failure: %w", err)
+		return fmt.Errorf("error reading or decoding file: %w", err)
+	}
+	if err := merkle.ValidateProof(ip); err != nil {
+		return fmt.Errorf("invalid proof: %w", err)
+	}
+	var rootHash []byte
+	given := "file"
+	if ctx.IsSet("leaf-hash") || ctx.IsSet("dir-hash") {
+		given = "hash"
+		rootHash, err = rootFromHash(ctx, ip)
+		if err != nil {
+			return err
+		}
+	} else {
+		f, err := os.Open(ctx.String("file"))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		rootHash, err = merkle.CalcInclusionProof(ip, f)
+		if err != nil {
+			return fmt.Errorf("unexpected verification failure: %w", err)
+		}
 	}
 
 	if len(ctx.String("hash")) > 0 {
@@ -242,10 +284,10 @@ func verifyInclusion(ctx *cli.Context) error {
 			return fmt.Errorf("failed to decode given hexadecimal hash: %w", err)
 		}
 		if bytes.Equal(givenRootHash, rootHash) {
-			fmt.Println("OK: proof and file match given root hash")
+			fmt.Printf("OK: proof and %s match given root hash\n", given)
 			return nil
 		}
-		fmt.Println("NOT OK: proof and file don't match given root hash")
+		fmt.Printf("NOT OK: proof and %s don't match given root hash\n", given)
 		return nil
 	}
 	if ctx.Bool("hex") {
@@ -256,33 +298,490 @@ func verifyInclusion(ctx *cli.Context) error {
 	return nil
 }
 
+// rootFromHash calculates the root hash for a proof from --leaf-hash, the
+// leaf hash of a file, or --dir-hash, the root hash of a directory.
+func rootFromHash(ctx *cli.Context, ip *merkle.InclusionProof) ([]byte, error) {
+	flag := "leaf-hash"
+	if ctx.IsSet("dir-hash") {
+		flag = "dir-hash"
+	}
+	hash, err := hex.DecodeString(ctx.String(flag))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode given hexadecimal hash: %w", err)
+	}
+	if len(hash) != merkle.Blake3Size {
+		return nil, fmt.Errorf("hash is %d bytes instead of %d", len(hash), merkle.Blake3Size)
+	}
+
+	var rootHash []byte
+	if flag == "dir-hash" {
+		rootHash, err = merkle.CalcDirInclusionProof(ip, hash)
+	} else {
+		if len(ip.Nonce) == 0 {
+			return nil, errors.New("proof is for a directory, use --dir-hash")
+		}
+		rootHash, err = merkle.CalcInclusionProofFromHash(ip, hash)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unexpected verification failure: %w", err)
+	}
+	return rootHash, nil
+}
+
+func checkProof(ctx *cli.Context) error {
+	ip, err := tree.ReadProofFile(ctx.String("proof"))
+	if err != nil {
+		return fmt.Errorf("error reading or decoding file: %w", err)
+	}
+	if err := merkle.ValidateProof(ip); err != nil {
+		fmt.Printf("NOT OK: %v\n", err)
+		return nil
+	}
+	if !ctx.IsSet("leaf-hash") && !ctx.IsSet("dir-hash") {
+		fmt.Println("OK: proof is well-formed")
+		return nil
+	}
+
+	rootHash, err := rootFromHash(ctx, ip)
+	if err != nil {
+		return err
+	}
+	if len(ctx.String("hash")) > 0 {
+		givenRootHash, err := hex.DecodeString(ctx.String("hash"))
+		if err != nil {
+			return fmt.Errorf("failed to decode given hexadecimal hash: %w", err)
+		}
+		if bytes.Equal(givenRootHash, rootHash) {
+			fmt.Println("OK: proof and hash match given root hash")
+			return nil
+		}
+		fmt.Println("NOT OK: proof and hash don't match given root hash")
+		return nil
+	}
+	fmt.Println("OK: proof is well-formed")
+	fmt.Printf("Root hash: %x\n", rootHash)
+	return nil
+}
+
+func diff(ctx *cli.Context) error {
+	from, err := tree.ReadFile(ctx.Args().Get(0))
+	if err != nil {
+		return fmt.Errorf("error reading or decoding file: %w", err)
+	}
+	to, err := tree.ReadFile(ctx.Args().Get(1))
+	if err != nil {
+		return fmt.Errorf("error reading or decoding file: %w", err)
+	}
+	d, err := tree.Compare(from, to)
+	if err != nil {
+		return err
+	}
+
+	if ctx.Bool("json") {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(d)
+	}
+	printDiff(d)
+	return nil
+}
+
+// printDiff lists the changes between two trees, with a summary.
+func printDiff(d *tree.Diff) {
+	for _, name := range d.Added {
+		fmt.Printf("Added: %s\n", name)
+	}
+	for _, name := range d.Removed {
+		fmt.Printf("Removed: %s\n", name)
+	}
+	for _, name := range d.Modified {
+		fmt.Printf("Modified: %s\n", name)
+	}
+	for _, m := range d.Moved {
+		fmt.Printf("Moved: %s -> %s\n", m.From, m.To)
+	}
+	if d.Empty() {
+		fmt.Println("No differences")
+		return
+	}
+	fmt.Printf("%d added, %d removed, %d modified, %d moved\n",
+		len(d.Added), len(d.Removed), len(d.Modified), len(d.Moved))
+}
+
+func which(ctx *cli.Context) error {
+	t, err := tree.ReadFile(ctx.String("tree"))
+	if err != nil {
+		return fmt.Errorf("error reading or decoding file: %w", err)
+	}
+	index, err := strconv.ParseUint(ctx.Args().First(), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid leaf index: %w", err)
+	}
+	names, err := t.LeafNames(path.Clean(ctx.String("dir")))
+	if err != nil {
+		return err
+	}
+	if index >= uint64(len(names)) {
+		return fmt.Errorf("leaf index out of range, there are %d leaves", len(names))
+	}
+	name := names[index]
+	if len(name) == 0 {
+		return errors.New("leaf was left out of this extracted tree")
+	}
+	leaf, err := t.Node(name)
+	if err != nil {
+		return err
+	}
+
+	if _, isDir := t.Dirs[name]; isDir {
+		fmt.Printf("Directory name: %s\n", name)
+		fmt.Printf("Root hash: %x\n", leaf.Hash)
+		return nil
+	}
+	fmt.Printf("File name: %s\n", name)
+	fmt.Printf("Leaf hash: %x\n", leaf.Hash)
+	fmt.Printf("Nonce: %x\n", leaf.Nonce)
+	return nil
+}
+
+func locate(ctx *cli.Context) error {
+	t, err := tree.ReadFile(ctx.String("tree"))
+	if err != nil {
+		return fmt.Errorf("error reading or decoding file: %w", err)
+	}
+	name := path.Clean(ctx.String("name"))
+	var found []string
+	if len(ctx.String("in")) > 0 {
+		in, err := tree.ReadFile(ctx.String("in"))
+		if err != nil {
+			return fmt.Errorf("error reading or decoding file: %w", err)
+		}
+		found, err = t.Locate(name, in)
+		if err != nil {
+			return err
+		}
+	} else {
+		found, err = t.LocateInDir(ctx.Context, name, ctx.String("dir"))
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(found) == 0 {
+		fmt.Println("Not found: no file has the same contents")
+		return nil
+	}
+	for _, other := range found {
+		fmt.Println(other)
+	}
+	return nil
+}
+
+func ls(ctx *cli.Context) error {
+	t, err := tree.ReadFile(ctx.Args().First())
+	if err != nil {
+		return fmt.Errorf("error reading or decoding file: %w", err)
+	}
+	opts := &tree.ListOptions{Glob: ctx.String("glob"), Sort: ctx.String("sort")}
+	if len(ctx.String("regex")) > 0 {
+		opts.Regexp, err = regexp.Compile(ctx.String("regex"))
+		if err != nil {
+			return fmt.Errorf("invalid regex: %w", err)
+		}
+	}
+	entries, err := t.List(opts)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, e := range entries {
+		if !ctx.Bool("long") {
+			fmt.Fprintf(w, "%d\t%s\n", e.Index, e.Name)
+			continue
+		}
+		leaf, err := t.Node(e.Name)
+		if err != nil {
+			return err
+		}
+		size, modTime := "-", "-"
+		if e.Meta != nil {
+			size = strconv.FormatInt(e.Meta.Size, 10)
+			modTime = time.Unix(0, e.Meta.ModTime).Format("2006-01-02 15:04:05")
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%x\t%s\n", e.Index, size, modTime, leaf.Hash, e.Name)
+	}
+	return w.Flush()
+}
+
+func graph(ctx *cli.Context) error {
+	t, err := tree.ReadFile(ctx.String("tree"))
+	if err != nil {
+		return fmt.Errorf("error reading or decoding file: %w", err)
+	}
+	node := t.Root
+	if len(ctx.String("dir")) > 0 {
+		if t.Mode != tree.ModeDirs {
+			return fmt.Errorf("only hierarchical trees have directory roots")
+		}
+		node, err = t.Node(path.Clean(ctx.String("dir")))
+		if err != nil {
+			return err
+		}
+	}
+	opts := &merkle.GraphOptions{
+		Format:   ctx.String("format"),
+		MaxDepth: ctx.Int("depth"),
+		MaxNodes: ctx.Int("max-nodes"),
+		Indexes:  make(map[*merkle.Node]uint64, len(t.Files)),
+		Names:    make(map[*merkle.Node]string, len(t.Dirs)),
+	}
+	for name, index := range t.Files {
+		leaf, err := t.Node(name)
+		if err != nil {
+			return err
+		}
+		opts.Indexes[leaf] = index
+	}
+	for dir := range t.Dirs {
+		if dir == "." {
+			continue
+		}
+		// Directories left out of an extracted tree can't be found
+		if dirNode, err := t.Node(dir); err == nil {
+			opts.Names[dirNode] = dir
+		}
+	}
+	if len(ctx.String("proof")) > 0 {
+		ip, err := tree.ReadProofFile(ctx.String("proof"))
+		if err != nil {
+			return fmt.Errorf("error reading or decoding file: %w", err)
+		}
+		if err := merkle.ValidateProof(ip); err != nil {
+			return fmt.Errorf("invalid proof: %w", err)
+		}
+		opts.Path, opts.Siblings, err = merkle.ProofNodes(node, ip)
+		if err != nil {
+			return fmt.Errorf("%w (use --dir for proofs relative to a directory)", err)
+		}
+	}
+	w := bufio.NewWriter(os.Stdout)
+	if err := node.WriteGraph(w, opts); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func dupes(ctx *cli.Context) error {
+	t, err := tree.ReadFile(ctx.Args().First())
+	if err != nil {
+		return fmt.Errorf("error reading or decoding file: %w", err)
+	}
+	groups, err := t.Duplicates()
+	if err != nil {
+		return err
+	}
+	var wasted int64
+	for _, g := range groups {
+		wasted += g.Wasted()
+	}
+
+	if ctx.Bool("json") {
+		type jsonGroup struct {
+			*tree.DupeGroup
+			Digest string `json:"digest"`
+			Wasted int64  `json:"wasted"`
+		}
+		out := struct {
+			Groups []jsonGroup `json:"groups"`
+			Wasted int64       `json:"wasted"`
+		}{Groups: make([]jsonGroup, len(groups)), Wasted: wasted}
+		for i, g := range groups {
+			out.Groups[i] = jsonGroup{g, hex.EncodeToString(g.Digest), g.Wasted()}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(out)
+	}
+	for _, g := range groups {
+		fmt.Printf("%d copies, %s each, %s wasted:\n", len(g.Files), formatBytes(float64(g.Size)),
+			formatBytes(float64(g.Wasted())))
+		for _, name := range g.Files {
+			fmt.Printf("  %s\n", name)
+		}
+	}
+	if len(groups) == 0 {
+		fmt.Println("No duplicate files")
+		return nil
+	}
+	fmt.Printf("%d sets of duplicates, %s wasted\n", len(groups), formatBytes(float64(wasted)))
+	return nil
+}
+
 func info(ctx *cli.Context) error {
-	t, err := readTree(ctx.Args().First())
+	t, err := tree.ReadFile(ctx.Args().First())
 	if err != nil {
 		return fmt.Errorf("error reading or decoding file: %w", err)
 	}
 
 	if len(ctx.String("proof")) > 0 {
 		// Info for inclusion proof
-		ip, err := readInclusionProof(ctx.String("proof"))
+		ip, err := tree.ReadProofFile(ctx.String("proof"))
 		if err != nil {
 			return fmt.Errorf("error reading or decoding file: %w", err)
 		}
-		leaf, err := merkle.GetLeaf(t.Root, ip.TreeSize, ip.LeafIndex)
+		if err := merkle.ValidateProof(ip); err != nil {
+			return fmt.Errorf("invalid proof: %w", err)
+		}
+		node := t.Root
+		if len(ctx.String("dir")) > 0 {
+			if t.Mode != tree.ModeDirs {
+				return fmt.Errorf("only hierarchical trees have directory roots")
+			}
+			node, err = t.Node(path.Clean(ctx.String("dir")))
+			if err != nil {
+				return err
+			}
+		}
+		proofPath, _, err := merkle.ProofNodes(node, ip)
 		if err != nil {
-			return fmt.Errorf("error finding leaf from inclusion proof in tree: %w", err)
+			return fmt.Errorf("%w (use --dir for proofs relative to a directory)", err)
+		}
+		leaf := proofPath[len(proofPath)-1]
+		proofLen := len(ip.Proof)
+		for _, parent := range ip.Parents {
+			proofLen += len(parent.Proof)
 		}
 		fmt.Printf("File index: %d\n", ip.LeafIndex)
-		fmt.Printf("File name: %s\n", leaf.Name)
-		fmt.Printf("Nonce: %x\n", ip.Nonce)
-		fmt.Printf("Proof length: %d hashes", len(ip.Proof))
+		if ip.Nonce == nil {
+			fmt.Printf("Directory name: %s\n", leaf.Name)
+		} else {
+			fmt.Printf("File name: %s\n", leaf.Name)
+			fmt.Printf("Nonce: %x\n", ip.Nonce)
+		}
+		if len(ip.Parents) > 0 {
+			fmt.Printf("Directory levels: %d\n", len(ip.Parents))
+		}
+		fmt.Printf("Proof length: %d hashes\n", proofLen)
 		return nil
 	}
 
 	// Info for tree
 	fmt.Printf("Root hash: %x\n", t.Root.Hash)
-	fmt.Printf("FS root: %s\n", t.Path)
+	if len(t.Roots) > 0 {
+		fmt.Println("FS roots:")
+		labels := make([]string, 0, len(t.Roots))
+		for label := range t.Roots {
+			labels = append(labels, label)
+		}
+		sort.Strings(labels)
+		for _, label := range labels {
+			fmt.Printf("  %s: %s\n", label, t.Roots[label].Path)
+		}
+	} else if t.Archive {
+		fmt.Printf("FS root: %s (archive)\n", t.Path)
+	} else if len(t.Path) > 0 {
+		// Extracted trees don't have one
+		fmt.Printf("FS root: %s\n", t.Path)
+	}
+	if len(t.Prefix) > 0 {
+		fmt.Printf("Extracted dir: %s\n", t.Prefix)
+	}
 	fmt.Printf("Num. of files: %d\n", len(t.Files))
+	if t.Mode == tree.ModeDirs {
+		fmt.Printf("Num. of dirs: %d (hierarchical)\n", len(t.Dirs))
+	}
+	if len(t.Symlinks) > 0 {
+		fmt.Printf("Symlinks: %s\n", t.Symlinks)
+	}
+	if t.ExpandArchives {
+		fmt.Println("Archives: expanded")
+	}
+	if t.HasDigests() {
+		fmt.Println("Content digests: yes")
+	} else {
+		fmt.Println("Content digests: no")
+	}
+	if len(t.Errors) > 0 {
+		fmt.Printf("Unreadable files left out: %d\n", len(t.Errors))
+	}
+	if t.Gen != nil && t.Gen.Ignored > 0 {
+		fmt.Printf("Special files left out: %d\n", t.Gen.Ignored)
+	}
+	if t.Gen != nil && t.Gen.SkippedLinks > 0 {
+		fmt.Printf("Symlinks left out: %d\n", t.Gen.SkippedLinks)
+	}
+	if t.Filter != nil {
+		fmt.Printf("Include patterns: %s\n", strings.Join(t.Filter.Include, " "))
+		fmt.Printf("Exclude patterns: %s\n", strings.Join(t.Filter.Exclude, " "))
+	}
+	fmt.Printf("Tree depth: %d\n", t.Root.Depth())
+
+	if t.Meta != nil {
+		files := make([]string, 0, len(t.Meta))
+		var total int64
+		for name, meta := range t.Meta {
+			files = append(files, name)
+			total += meta.Size
+		}
+		fmt.Printf("Total size: %s (%d bytes)\n", formatBytes(float64(total)), total)
+		sort.Slice(files, func(i, j int) bool {
+			a, b := t.Meta[files[i]].Size, t.Meta[files[j]].Size
+			if a != b {
+				return a > b
+			}
+			return files[i] < files[j]
+		})
+		if len(files) > largestFiles {
+			files = files[:largestFiles]
+		}
+		fmt.Println("Largest files:")
+		for _, name := range files {
+			fmt.Printf("  %s  %s\n", formatBytes(float64(t.Meta[name].Size)), name)
+		}
+	}
+
+	// Older trees don't store these, but were all the first format and hash
+	format, algorithm := t.Format, t.Algorithm
+	if format == 0 {
+		format = 1
+	}
+	if len(algorithm) == 0 {
+		algorithm = tree.HashAlgorithm
+	}
+	fmt.Printf("Format version: %d\n", format)
+	fmt.Printf("Hash algorithm: %s\n", algorithm)
+	if t.Gen != nil {
+		if len(t.Gen.Version) > 0 {
+			fmt.Printf("Generated by: merkdir %s\n", t.Gen.Version)
+		}
+		if len(t.Gen.User) > 0 || len(t.Gen.Host) > 0 {
+			fmt.Printf("Generated on: %s@%s\n", t.Gen.User, t.Gen.Host)
+		}
+		if len(t.Gen.Args) > 0 {
+			fmt.Printf("Generated with: merkdir %s\n", strings.Join(t.Gen.Args, " "))
+		}
+	}
 	fmt.Printf("Creation time: %v\n", t.CreatedAt)
 	return nil
 }
+
+// largestFiles is how many of the biggest files info lists.
+const largestFiles = 5
+
+// genInfo returns the details about this program to store in generated trees.
+func genInfo() *tree.GenInfo {
+	gen := &tree.GenInfo{Version: version, Args: os.Args[1:]}
+	if len(gen.Version) == 0 {
+		gen.Version = "(development build)"
+	}
+	if len(commit) > 0 {
+		gen.Version += " (" + commit + ")"
+	}
+	// These are only informational, so errors can be ignored
+	gen.Host, _ = os.Hostname()
+	if u, err := user.Current(); err == nil {
+		gen.User = u.Username
+	}
+	return gen
+}
@@ -1,12 +1,13 @@
 module github.com/makew0rld/merkdir
 
-go 1.21.1
+go 1.22
 
 require (
 	github.com/fxamacker/cbor/v2 v2.5.0
 	github.com/schollz/progressbar/v3 v3.14.1
 	github.com/urfave/cli/v2 v2.25.7
-	lukechampine.com/blake3 v1.2.1
+	golang.org/x/term v0.14.0
+	lukechampine.com/blake3 v1.4.1
 )
 
 require (
@@ -18,5 +19,4 @@ require (
 	github.com/x448/float16 v0.8.4 // indirect
 	github.com/xrash/smetrics v0.0.0-20201216005158-039620a65673 // indirect
 	golang.org/x/sys v0.14.0 // indirect
-	golang.org/x/term v0.14.0 // indirect
 )
@@ -1,9 +1,15 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"math"
 	"os"
+	"strconv"
+	"strings"
 
+	"github.com/makew0rld/merkdir/merkle"
+	"github.com/makew0rld/merkdir/tree"
 	"github.com/urfave/cli/v2"
 )
 
@@ -29,26 +35,121 @@ func main() {
 				},
 			},
 			{
-				Name:   "gen",
-				Usage:  "generate a merkle tree",
-				Action: gen,
-				Flags: []cli.Flag{
+				Name:      "gen",
+				Usage:     "generate a merkle tree",
+				ArgsUsage: "[label=]path...",
+				Action:    gen,
+				Flags: append([]cli.Flag{
 					&cli.StringFlag{
 						Name:     "output",
 						Aliases:  []string{"o"},
 						Usage:    "output tree file",
 						Required: true,
 					},
+					&cli.BoolFlag{
+						Name:  "no-clobber",
+						Usage: "refuse to overwrite an existing output file",
+					},
+					&cli.BoolFlag{
+						Name:  "dirs",
+						Usage: "mirror the directory hierarchy, making each directory a subtree of its parent",
+					},
+					&cli.BoolFlag{
+						Name:  "no-digests",
+						Usage: "don't store unsalted content digests, which are needed to compare trees",
+					},
+					&cli.StringSliceFlag{
+						Name:  "include",
+						Usage: "only include files matching this glob, can be repeated",
+					},
+					&cli.StringSliceFlag{
+						Name:  "exclude",
+						Usage: "exclude files matching this gitignore-style pattern, can be repeated",
+					},
+					&cli.StringFlag{
+						Name:  "symlinks",
+						Usage: "how to handle symlinks: skip, follow, or record the link target as a leaf",
+						Value: tree.SymlinksSkip,
+					},
+					&cli.BoolFlag{
+						Name:  "expand-archives",
+						Usage: "treat zip and tar files as directories, hashing each member as a leaf",
+					},
+					&cli.StringFlag{
+						Name:  "from-tar",
+						Usage: "hash the files inside this tar file instead of a directory, it can be gzipped",
+					},
+					&cli.StringFlag{
+						Name:  "from-zip",
+						Usage: "hash the files inside this zip file instead of a directory",
+					},
+					&cli.StringFlag{
+						Name:  "checkpoint",
+						Usage: "save progress to this file while hashing, so an interrupted run can be resumed",
+					},
+					&cli.BoolFlag{
+						Name:  "resume",
+						Usage: "continue from the checkpoint file, skipping files that haven't changed since",
+					},
+				}, hashFlags()...),
+				Before: func(ctx *cli.Context) error {
+					if err := checkClobber(ctx); err != nil {
+						return err
+					}
+					// Validate path arguments
+					if ctx.IsSet("from-tar") || ctx.IsSet("from-zip") {
+						if ctx.Args().Len() != 0 || (ctx.IsSet("from-tar") && ctx.IsSet("from-zip")) {
+							return fmt.Errorf("only one archive can be used, without any dir or file paths")
+						}
+					} else if ctx.Args().Len() == 0 {
+						return fmt.Errorf("at least one dir or file path is required")
+					}
+					for _, arg := range ctx.Args().Slice() {
+						if _, _, err := tree.ParseRootArg(arg); err != nil {
+							return err
+						}
+					}
+					if ctx.Bool("resume") && !ctx.IsSet("checkpoint") {
+						return fmt.Errorf("--resume requires --checkpoint")
+					}
+					switch ctx.String("symlinks") {
+					case tree.SymlinksSkip, tree.SymlinksFollow, tree.SymlinksRecord:
+					default:
+						return fmt.Errorf("invalid symlink policy: %s", ctx.String("symlinks"))
+					}
+					return checkHashFlags(ctx)
 				},
+			},
+			{
+				Name:   "update",
+				Usage:  "generate a new version of a tree, only hashing files that changed",
+				Action: update,
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:     "tree",
+						Usage:    "input tree file",
+						Aliases:  []string{"t"},
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:     "output",
+						Aliases:  []string{"o"},
+						Usage:    "output tree file, can be the same as the input",
+						Required: true,
+					},
+					&cli.BoolFlag{
+						Name:  "no-clobber",
+						Usage: "refuse to overwrite an existing output file",
+					},
+				}, hashFlags()...),
 				Before: func(ctx *cli.Context) error {
-					// Validate path argument
-					if ctx.Args().Len() != 1 {
-						return fmt.Errorf("only one argument allowed: dir path")
+					if ctx.Args().Len() != 0 {
+						return fmt.Errorf("command requires no arguments")
 					}
-					if fi, err := os.Stat(ctx.Args().First()); err == nil && fi.IsDir() {
-						return nil
+					if err := checkClobber(ctx); err != nil {
+						return err
 					}
-					return fmt.Errorf("not a valid path to a directory")
+					return checkHashFlags(ctx)
 				},
 			},
 			{
@@ -60,6 +161,10 @@ func main() {
 						Name:  "hex",
 						Usage: "get hash as hex",
 					},
+					&cli.StringFlag{
+						Name:  "dir",
+						Usage: "get the root hash of this directory instead (hierarchical trees only)",
+					},
 				},
 				Before: func(ctx *cli.Context) error {
 					// Validate path argument
@@ -82,10 +187,15 @@ func main() {
 					},
 					&cli.StringFlag{
 						Name:     "file",
-						Usage:    "file path as stored in the tree",
+						Usage:    "file path as stored in the tree, or directory path for hierarchical trees",
 						Aliases:  []string{"f"},
 						Required: true,
 					},
+					&cli.StringFlag{
+						Name:  "relative-to",
+						Usage: "directory whose root hash the proof leads to (hierarchical trees only)",
+						Value: ".",
+					},
 					&cli.StringFlag{
 						Name:    "output",
 						Usage:   "output path for inclusion proof (otherwise text version goes to stdout)",
@@ -99,6 +209,41 @@ func main() {
 					return nil
 				},
 			},
+			{
+				Name:   "extract",
+				Usage:  "create a tree with only the files in one directory, with the same root hash",
+				Action: extract,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "tree",
+						Usage:    "input tree file",
+						Aliases:  []string{"t"},
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:     "dir",
+						Usage:    "directory path as stored in the tree",
+						Aliases:  []string{"d"},
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:     "output",
+						Usage:    "output tree file",
+						Aliases:  []string{"o"},
+						Required: true,
+					},
+					&cli.BoolFlag{
+						Name:  "no-clobber",
+						Usage: "refuse to overwrite an existing output file",
+					},
+				},
+				Before: func(ctx *cli.Context) error {
+					if ctx.Args().Len() != 0 {
+						return fmt.Errorf("command requires no arguments")
+					}
+					return checkClobber(ctx)
+				},
+			},
 			{
 				Name:   "verify-file",
 				Usage:  "check if a file on disk is still part of the merkle tree",
@@ -124,6 +269,26 @@ func main() {
 					return nil
 				},
 			},
+			{
+				Name:      "verify-dir",
+				Usage:     "check if a directory on disk still matches the merkle tree",
+				ArgsUsage: "[dir]",
+				Action:    verifyDir,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "tree",
+						Usage:    "input tree file",
+						Aliases:  []string{"t"},
+						Required: true,
+					},
+				},
+				Before: func(ctx *cli.Context) error {
+					if ctx.Args().Len() > 1 {
+						return fmt.Errorf("only one argument allowed: dir path, defaults to the path in the tree")
+					}
+					return nil
+				},
+			},
 			{
 				Name:   "verify-inclusion",
 				Usage:  "get the root hash for a given inclusion proof and file",
@@ -136,10 +301,17 @@ func main() {
 						Required: true,
 					},
 					&cli.StringFlag{
-						Name:     "file",
-						Usage:    "path to leaf file",
-						Aliases:  []string{"f"},
-						Required: true,
+						Name:    "file",
+						Usage:   "path to leaf file",
+						Aliases: []string{"f"},
+					},
+					&cli.StringFlag{
+						Name:  "leaf-hash",
+						Usage: "hex leaf hash of the file to use instead of the file, which you calculated yourself",
+					},
+					&cli.StringFlag{
+						Name:  "dir-hash",
+						Usage: "hex root hash of a directory, for proofs of directories in hierarchical trees",
 					},
 					&cli.BoolFlag{
 						Name:  "hex",
@@ -154,6 +326,236 @@ func main() {
 					if ctx.Args().Len() != 0 {
 						return fmt.Errorf("command requires no arguments")
 					}
+					n := 0
+					for _, name := range []string{"file", "leaf-hash", "dir-hash"} {
+						if ctx.IsSet(name) {
+							n++
+						}
+					}
+					if n != 1 {
+						return fmt.Errorf("exactly one of --file, --leaf-hash, or --dir-hash is required")
+					}
+					return nil
+				},
+			},
+			{
+				Name:   "graph",
+				Usage:  "draw a tree as a graph, for graphviz or Mermaid",
+				Action: graph,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "tree",
+						Usage:    "input tree file",
+						Aliases:  []string{"t"},
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:  "dir",
+						Usage: "only draw this directory (hierarchical trees only)",
+					},
+					&cli.IntFlag{
+						Name:  "depth",
+						Usage: "number of levels to draw below the root (default: all)",
+					},
+					&cli.IntFlag{
+						Name:  "max-nodes",
+						Usage: "collapse subtrees so at most this many nodes are drawn, 0 for no limit",
+						Value: 1000,
+					},
+					&cli.StringFlag{
+						Name:    "proof",
+						Usage:   "highlight the nodes used by this inclusion proof",
+						Aliases: []string{"p"},
+					},
+					&cli.StringFlag{
+						Name:  "format",
+						Usage: "output format: dot or mermaid",
+						Value: merkle.GraphDot,
+					},
+				},
+				Before: func(ctx *cli.Context) error {
+					if ctx.Args().Len() != 0 {
+						return fmt.Errorf("command requires no arguments")
+					}
+					if ctx.Int("depth") < 0 || ctx.Int("max-nodes") < 0 {
+						return fmt.Errorf("depth and max nodes can't be negative")
+					}
+					switch ctx.String("format") {
+					case merkle.GraphDot, merkle.GraphMermaid:
+					default:
+						return fmt.Errorf("invalid graph format: %s", ctx.String("format"))
+					}
+					return nil
+				},
+			},
+			{
+				Name:   "check-proof",
+				Usage:  "check that an inclusion proof is well-formed, without the file",
+				Action: checkProof,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "proof",
+						Usage:    "inclusion proof file",
+						Aliases:  []string{"p"},
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:  "leaf-hash",
+						Usage: "hex leaf hash of the file, to also calculate the root hash",
+					},
+					&cli.StringFlag{
+						Name:  "dir-hash",
+						Usage: "hex root hash of a directory, to also calculate the root hash",
+					},
+					&cli.StringFlag{
+						Name:  "hash",
+						Usage: "hex root hash to compare to, requires --leaf-hash or --dir-hash",
+					},
+				},
+				Before: func(ctx *cli.Context) error {
+					if ctx.Args().Len() != 0 {
+						return fmt.Errorf("command requires no arguments")
+					}
+					if ctx.IsSet("leaf-hash") && ctx.IsSet("dir-hash") {
+						return fmt.Errorf("only one of --leaf-hash or --dir-hash can be used")
+					}
+					if ctx.IsSet("hash") && !ctx.IsSet("leaf-hash") && !ctx.IsSet("dir-hash") {
+						return fmt.Errorf("--hash requires --leaf-hash or --dir-hash")
+					}
+					return nil
+				},
+			},
+			{
+				Name:      "diff",
+				Usage:     "list the files that were added, removed, modified, or moved between two trees",
+				ArgsUsage: "old-tree new-tree",
+				Action:    diff,
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "json",
+						Usage: "output JSON instead of text",
+					},
+				},
+				Before: func(ctx *cli.Context) error {
+					if ctx.Args().Len() != 2 {
+						return fmt.Errorf("command requires two args: the old and new tree files")
+					}
+					return nil
+				},
+			},
+			{
+				Name:      "ls",
+				Usage:     "list the files in a tree with their leaf numbers",
+				ArgsUsage: "tree",
+				Action:    ls,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "glob",
+						Usage: "only list files matching this glob, matched against the file name unless it has a slash",
+					},
+					&cli.StringFlag{
+						Name:  "regex",
+						Usage: "only list files whose path matches this regular expression",
+					},
+					&cli.StringFlag{
+						Name:  "sort",
+						Usage: "sort by name or index, the order of the leaves in the tree",
+						Value: tree.SortName,
+					},
+					&cli.BoolFlag{
+						Name:    "long",
+						Aliases: []string{"l"},
+						Usage:   "also show the size, modification time, and leaf hash of each file",
+					},
+				},
+				Before: func(ctx *cli.Context) error {
+					if ctx.Args().Len() != 1 {
+						return fmt.Errorf("command requires one arg: the tree file")
+					}
+					switch ctx.String("sort") {
+					case tree.SortName, tree.SortIndex:
+					default:
+						return fmt.Errorf("invalid sort order: %s", ctx.String("sort"))
+					}
+					return nil
+				},
+			},
+			{
+				Name:      "which",
+				Usage:     "find the file at a leaf number, like the index in a proof",
+				ArgsUsage: "index",
+				Action:    which,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "tree",
+						Usage:    "input tree file",
+						Aliases:  []string{"t"},
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:  "dir",
+						Usage: "directory the leaf number is relative to (hierarchical trees only)",
+						Value: ".",
+					},
+				},
+				Before: func(ctx *cli.Context) error {
+					if ctx.Args().Len() != 1 {
+						return fmt.Errorf("command requires one arg: the leaf index")
+					}
+					return nil
+				},
+			},
+			{
+				Name:   "locate",
+				Usage:  "find where a file in a tree is now, by its contents",
+				Action: locate,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "tree",
+						Usage:    "input tree file",
+						Aliases:  []string{"t"},
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:     "name",
+						Usage:    "name/path of file in merkle tree",
+						Aliases:  []string{"n"},
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:  "in",
+						Usage: "search this newer tree file",
+					},
+					&cli.StringFlag{
+						Name:  "dir",
+						Usage: "search the files in this directory",
+					},
+				},
+				Before: func(ctx *cli.Context) error {
+					if ctx.Args().Len() != 0 {
+						return fmt.Errorf("command requires no arguments")
+					}
+					if ctx.IsSet("in") == ctx.IsSet("dir") {
+						return fmt.Errorf("exactly one of --in or --dir is required")
+					}
+					return nil
+				},
+			},
+			{
+				Name:      "dupes",
+				Usage:     "list files in a tree with identical contents, and the space they waste",
+				ArgsUsage: "tree",
+				Action:    dupes,
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "json",
+						Usage: "output JSON instead of text",
+					},
+				},
+				Before: func(ctx *cli.Context) error {
+					if ctx.Args().Len() != 1 {
+						return fmt.Errorf("command requires one arg: the tree file")
+					}
 					return nil
 				},
 			},
@@ -167,6 +569,10 @@ func main() {
 						Usage:   "inclusion proof file",
 						Aliases: []string{"p"},
 					},
+					&cli.StringFlag{
+						Name:  "dir",
+						Usage: "directory the proof is relative to (hierarchical trees only)",
+					},
 				},
 				Before: func(ctx *cli.Context) error {
 					if ctx.Args().Len() != 1 {
@@ -179,7 +585,108 @@ func main() {
 	}
 
 	if err := app.Run(os.Args); err != nil {
-		fmt.Printf("%v\n", err)
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		if errors.Is(err, tree.ErrNoDigests) {
+			fmt.Fprintln(os.Stderr, "Trees made with --no-digests or by older versions of merkdir don't have them.")
+		}
 		os.Exit(1)
 	}
 }
+
+// checkClobber fails early if --no-clobber is set and the output file exists,
+// instead of after all the work is done.
+func checkClobber(ctx *cli.Context) error {
+	if !ctx.Bool("no-clobber") {
+		return nil
+	}
+	if _, err := os.Lstat(ctx.String("output")); err == nil {
+		return fmt.Errorf("not overwriting existing file %s", ctx.String("output"))
+	}
+	return nil
+}
+
+// hashFlags returns the flags for how files are read and hashed, which gen and
+// update share.
+func hashFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:  "on-error",
+			Usage: "what to do with unreadable files: abort, skip, or record them in the tree",
+			Value: tree.OnErrorAbort,
+		},
+		&cli.IntFlag{
+			Name:    "jobs",
+			Aliases: []string{"j"},
+			Usage:   "number of files to hash at once (default: twice the number of CPUs)",
+		},
+		&cli.IntFlag{
+			Name:  "device-jobs",
+			Usage: "max number of files to read at once from each disk, lower is better for spinning disks (default: no limit)",
+		},
+		&cli.StringFlag{
+			Name:  "buffer-size",
+			Usage: "size of each read from a file, like 64K or 4M",
+		},
+		&cli.StringFlag{
+			Name:  "parallel-size",
+			Usage: "hash files at least this big using all CPU cores, 0 to never do this",
+			Value: "64M",
+		},
+		&cli.StringFlag{
+			Name:  "progress",
+			Usage: "how to show progress on stderr: bar, log, json, or none (default: bar in a terminal, log otherwise)",
+		},
+	}
+}
+
+// checkHashFlags validates the flags from hashFlags.
+func checkHashFlags(ctx *cli.Context) error {
+	if ctx.Int("jobs") < 0 || ctx.Int("device-jobs") < 0 {
+		return fmt.Errorf("number of jobs can't be negative")
+	}
+	if _, err := parseSize(ctx.String("buffer-size")); err != nil {
+		return err
+	}
+	if _, err := parseSize(ctx.String("parallel-size")); err != nil {
+		return err
+	}
+	switch ctx.String("progress") {
+	case "", progressBar, progressLog, progressJSON, progressNone:
+	default:
+		return fmt.Errorf("invalid progress mode: %s", ctx.String("progress"))
+	}
+	switch ctx.String("on-error") {
+	case tree.OnErrorAbort, tree.OnErrorSkip, tree.OnErrorRecord:
+	default:
+		return fmt.Errorf("invalid error policy: %s", ctx.String("on-error"))
+	}
+	return nil
+}
+
+// parseSize parses a number of bytes with an optional K, M, or G suffix, which
+// are powers of 1024. An empty string is zero.
+func parseSize(s string) (int, error) {
+	if len(s) == 0 {
+		return 0, nil
+	}
+	num, mult := s, 1
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		mult = 1 << 10
+	case "M":
+		mult = 1 << 20
+	case "G":
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		num = s[:len(s)-1]
+	}
+	n, err := strconv.Atoi(num)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size: %s", s)
+	}
+	if n > math.MaxInt/mult {
+		return 0, fmt.Errorf("size is too big: %s", s)
+	}
+	return n * mult, nil
+}
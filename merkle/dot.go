@@ -3,55 +3,285 @@ package merkle
 import (
 	"fmt"
 	"io"
+	"strings"
 )
 
-// Output tree in DOT language, for rendering with graphviz
+// Output tree in DOT language, for rendering with graphviz, or as a Mermaid
+// flowchart for docs
 
-func (n *Node) dotNodeName() string {
-	// Name the node using a bit of the hash, unless it has a filename
-	name := fmt.Sprintf("%x", n.Hash[:3])
+// Graph formats
+const (
+	GraphDot     = "dot"
+	GraphMermaid = "mermaid"
+)
+
+// labelHashSize is how many bytes of a node's hash are shown in its label.
+const labelHashSize = 4
+
+// GraphOptions changes how WriteGraph draws a tree.
+type GraphOptions struct {
+	Format   string // GraphDot or GraphMermaid, empty is GraphDot
+	MaxDepth int    // Number of levels to draw below the root, 0 for all of them
+	// Subtrees are collapsed into a single node once this many nodes would be
+	// drawn, starting from the top. 0 draws all of them.
+	MaxNodes int
+	// Nodes to highlight, usually from ProofNodes. Path is drawn in one color,
+	// and Siblings in another.
+	Path     []*Node
+	Siblings []*Node
+	// Extra details for nodes, usually from the tree file. Leaf numbers are
+	// shown with leaves, and names are used for nodes without one, like the
+	// directories of hierarchical trees.
+	Indexes map[*Node]uint64
+	Names   map[*Node]string
+}
+
+// Classes of highlighted nodes
+const (
+	highlightPath    = "path"
+	highlightSibling = "sibling"
+)
+
+// Fill colors for highlighted nodes
+var highlightColors = map[string]string{
+	highlightPath:    "#99ccff",
+	highlightSibling: "#ffcc99",
+}
+
+// graphWriter draws one tree. The first write error is kept, and everything
+// after it is skipped.
+type graphWriter struct {
+	w         io.Writer
+	opts      *GraphOptions
+	highlight map[*Node]string
+	expanded  map[*Node]bool   // Nodes whose children are drawn
+	ids       map[*Node]string // Nodes that were drawn
+	drawn     []*Node          // In the order they were first drawn
+	err       error
+}
+
+func (g *graphWriter) printf(format string, a ...any) {
+	if g.err != nil {
+		return
+	}
+	_, g.err = fmt.Fprintf(g.w, format, a...)
+}
+
+// expand chooses which nodes have their children drawn, going down the tree
+// one level at a time until the depth or node limit is reached. This keeps the
+// top of the tree when collapsing, rather than one deep branch. Nodes on
+// opts.Path are expanded regardless of the limits, so the whole proof is drawn.
+func (g *graphWriter) expand(root *Node) {
+	count := 1
+	full := false
+	level := []*Node{root}
+	for depth := 0; len(level) > 0; depth++ {
+		deep := g.opts.MaxDepth > 0 && depth >= g.opts.MaxDepth
+		var next []*Node
+		for _, n := range level {
+			kids := children(n)
+			if len(kids) == 0 {
+				continue
+			}
+			if g.highlight[n] != highlightPath {
+				if deep || full {
+					continue
+				}
+				if g.opts.MaxNodes > 0 && count+len(kids) > g.opts.MaxNodes {
+					full = true
+					continue
+				}
+			}
+			g.expanded[n] = true
+			count += len(kids)
+			next = append(next, kids...)
+		}
+		level = next
+	}
+}
+
+// children returns the nodes drawn below a node. Directory leaves have the
+// root of the directory's tree below them.
+func children(n *Node) []*Node {
+	if n.Dir != nil {
+		return []*Node{n.Dir}
+	}
+	if n.Left == nil || n.Right == nil {
+		return nil
+	}
+	return []*Node{n.Left, n.Right}
+}
+
+// collapsed reports whether the node has children that aren't drawn.
+func (g *graphWriter) collapsed(n *Node) bool {
+	return len(children(n)) > 0 && !g.expanded[n]
+}
+
+// leaves counts the file leaves under a node, for collapsed subtrees.
+func leaves(n *Node) int {
+	kids := children(n)
+	if len(kids) == 0 {
+		if len(n.Nonce) > 0 {
+			return 1
+		}
+		// Empty tree, or pruned subtree of unknown size
+		return 0
+	}
+	count := 0
+	for _, kid := range kids {
+		count += leaves(kid)
+	}
+	return count
+}
+
+// label returns the lines of text describing a node.
+func (g *graphWriter) label(n *Node) []string {
+	hash := fmt.Sprintf("%x…", n.Hash[:min(labelHashSize, len(n.Hash))])
+	var lines []string
 	if len(n.Name) > 0 {
-		name = n.Name
+		lines = append(lines, n.Name)
+	} else if name, ok := g.opts.Names[n]; ok {
+		lines = append(lines, name+"/")
+	}
+	if i, ok := g.opts.Indexes[n]; ok {
+		lines = append(lines, fmt.Sprintf("#%d", i))
 	}
-	return name
+	lines = append(lines, hash)
+	if g.collapsed(n) {
+		lines = append(lines, fmt.Sprintf("(%d leaves hidden)", leaves(n)))
+	}
+	return lines
 }
 
-// getDot just writes the relationships, and not the boilerplate of the graph.
-func (n *Node) getDot(w io.Writer) error {
-	// Depth-first search
+// dotEscape escapes text for a quoted DOT string. Backslashes are escaped too,
+// since escapes like \N and \l have special meanings in labels.
+func dotEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`).Replace(s)
+}
+
+// mermaidEscape escapes text for a quoted Mermaid label, using entity codes.
+func mermaidEscape(s string) string {
+	return strings.NewReplacer("#", "#35;", `"`, "#quot;", "<", "#lt;", ">", "#gt;",
+		"\n", " ", "\r", " ").Replace(s)
+}
 
-	if n.Left != nil {
-		_, err := fmt.Fprintf(w, `"%s" -> "%s"`+"\n", n.dotNodeName(), n.Left.dotNodeName())
-		if err != nil {
-			return err
+// id returns how the node is referred to in the graph. The first time a node is
+// drawn it is declared along with its label. Every node gets its own ID, since
+// names and hashes aren't always unique, like for duplicate files.
+func (g *graphWriter) id(n *Node) string {
+	if id, ok := g.ids[n]; ok {
+		return id
+	}
+	id := fmt.Sprintf("n%d", len(g.ids))
+	g.ids[n] = id
+	g.drawn = append(g.drawn, n)
+
+	lines := g.label(n)
+	collapsed := g.collapsed(n)
+	if g.opts.Format == GraphMermaid {
+		for i := range lines {
+			lines[i] = mermaidEscape(lines[i])
 		}
-		if err := n.Left.getDot(w); err != nil {
-			return err
+		if collapsed {
+			return fmt.Sprintf(`%s[["%s"]]`, id, strings.Join(lines, "<br>"))
 		}
+		return fmt.Sprintf(`%s["%s"]`, id, strings.Join(lines, "<br>"))
+	}
+	for i := range lines {
+		lines[i] = dotEscape(lines[i])
+	}
+	attrs := fmt.Sprintf(`label="%s"`, strings.Join(lines, `\n`))
+	if n.Dir != nil || n.Left == nil || n.Right == nil {
+		attrs += ", shape=box"
 	}
-	if n.Right != nil {
-		_, err := fmt.Fprintf(w, `"%s" -> "%s"`+"\n", n.dotNodeName(), n.Right.dotNodeName())
-		if err != nil {
-			return err
+	if collapsed {
+		attrs += ", style=dashed"
+	}
+	g.printf("%s [%s]\n", id, attrs)
+	return id
+}
+
+// edges just writes the relationships, and not the boilerplate of the graph.
+func (g *graphWriter) edges(n *Node) {
+	// Depth-first search
+
+	if !g.expanded[n] {
+		return
+	}
+	arrow := "->"
+	if g.opts.Format == GraphMermaid {
+		arrow = "-->"
+	}
+	for _, child := range children(n) {
+		from := g.id(n)
+		to := g.id(child)
+		g.printf("%s %s %s\n", from, arrow, to)
+		g.edges(child)
+	}
+}
+
+// WriteGraph writes a complete directed graph for the tree that this node is
+// the root of. If an error is returned, the written bytes are likely not a
+// valid graph.
+func (n *Node) WriteGraph(w io.Writer, opts *GraphOptions) error {
+	g := &graphWriter{
+		w:         w,
+		opts:      opts,
+		highlight: make(map[*Node]string),
+		expanded:  make(map[*Node]bool),
+		ids:       make(map[*Node]string),
+	}
+	for _, node := range opts.Path {
+		g.highlight[node] = highlightPath
+	}
+	for _, node := range opts.Siblings {
+		g.highlight[node] = highlightSibling
+	}
+	g.expand(n)
+
+	switch opts.Format {
+	case "", GraphDot:
+		g.printf(`digraph "%x" {`+"\n", n.Hash)
+		g.id(n)
+		g.edges(n)
+		// Only nodes that were drawn, so ones that were collapsed don't appear
+		for _, node := range g.drawn {
+			class, ok := g.highlight[node]
+			if !ok {
+				continue
+			}
+			style := "filled"
+			if g.collapsed(node) {
+				style = "filled,dashed"
+			}
+			g.printf("%s [style=%q, fillcolor=%q]\n", g.ids[node], style, highlightColors[class])
 		}
-		if err := n.Right.getDot(w); err != nil {
-			return err
+		g.printf("}\n")
+	case GraphMermaid:
+		g.printf("graph TD\n")
+		g.printf("%s\n", g.id(n))
+		g.edges(n)
+		for _, class := range []string{highlightPath, highlightSibling} {
+			var ids []string
+			for _, node := range g.drawn {
+				if g.highlight[node] == class {
+					ids = append(ids, g.ids[node])
+				}
+			}
+			if len(ids) > 0 {
+				g.printf("classDef %s fill:%s\n", class, highlightColors[class])
+				g.printf("class %s %s\n", strings.Join(ids, ","), class)
+			}
 		}
+	default:
+		return fmt.Errorf("invalid graph format: %s", opts.Format)
 	}
-	return nil
+	return g.err
 }
 
 // DotGraph writes a complete directed graph for the tree that this node is the root of.
 // It uses the DOT language. If an error is returned, the written bytes are likely not a valid
 // DOT file.
 func (n *Node) DotGraph(w io.Writer) error {
-	_, err := fmt.Fprintf(w, `digraph "%x" {`+"\n", n.Hash)
-	if err != nil {
-		return err
-	}
-	if err := n.getDot(w); err != nil {
-		return err
-	}
-	_, err = fmt.Fprint(w, "}")
-	return err
+	return n.WriteGraph(w, &GraphOptions{Format: GraphDot})
 }
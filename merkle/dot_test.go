@@ -0,0 +1,60 @@
+package merkle
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// TestGraphProof checks that the whole proof is drawn, even when the rest of
+// the tree is collapsed.
+func TestGraphProof(t *testing.T) {
+	leaves, _ := testLeaves(t, 64)
+	root := CreateTree(leaves)
+	proof, err := GetInclusionProof(root, 64, 37)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path, siblings, err := ProofNodes(root, proof)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		opts GraphOptions
+	}{
+		{"all", GraphOptions{}},
+		{"max nodes", GraphOptions{MaxNodes: 5}},
+		{"max depth", GraphOptions{MaxDepth: 2}},
+		{"mermaid", GraphOptions{Format: GraphMermaid, MaxNodes: 5, MaxDepth: 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := tt.opts
+			opts.Path, opts.Siblings = path, siblings
+			var buf bytes.Buffer
+			if err := root.WriteGraph(&buf, &opts); err != nil {
+				t.Fatal(err)
+			}
+			out := buf.String()
+			if !strings.Contains(out, "f37") {
+				t.Error("proven leaf isn't drawn")
+			}
+			for i, s := range siblings {
+				if !strings.Contains(out, fmt.Sprintf("%x…", s.Hash[:labelHashSize])) {
+					t.Errorf("sibling %d isn't drawn", i)
+				}
+			}
+		})
+	}
+
+	var buf bytes.Buffer
+	if err := root.WriteGraph(&buf, &GraphOptions{MaxNodes: 5}); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), "f37") {
+		t.Error("leaf is drawn without a proof, MaxNodes is ignored")
+	}
+}
@@ -5,6 +5,7 @@
 package merkle
 
 import (
+	"bytes"
 	"crypto/rand"
 	"errors"
 	"fmt"
@@ -28,6 +29,9 @@ type Node struct {
 	// Random nonce that was prepended to data before calculating hash
 	// Only used for leaf nodes to anonymize actual file hash
 	Nonce Nonce `cbor:",omitempty"`
+	// For leaves that are directories in a hierarchical tree, the root of the
+	// directory's own tree. The leaf hash is HashDirLeaf of its hash.
+	Dir *Node `cbor:",omitempty"`
 }
 
 func (n *Node) String() string {
@@ -40,6 +44,9 @@ type InclusionProof struct {
 	TreeSize  uint64   // number of leaves
 	Nonce     []byte   // Nonce for proven leaf
 	Proof     [][]byte // Node hashes, in bottom-to-top order
+	// Proofs for each enclosing tree, innermost first. Used by hierarchical trees,
+	// where the root of one tree is a leaf of the next. Nonce is unused for these.
+	Parents []*InclusionProof `cbor:",omitempty"`
 }
 
 // flp2 returns the previous power of 2 for the given integer.
@@ -66,17 +73,108 @@ func HashLeaf(r io.Reader, nonce Nonce) ([]byte, error) {
 	return hasher.Sum(nil), nil
 }
 
+// HashLeafBuffer is like HashLeaf, but reads from r using the given buffer,
+// so the size of each read can be chosen.
+func HashLeafBuffer(r io.Reader, nonce Nonce, buf []byte) ([]byte, error) {
+	hasher := blake3.New(Blake3Size, nil)
+	hasher.Write([]byte{0x00})
+	hasher.Write(nonce)
+	_, err := io.CopyBuffer(hasher, r, buf)
+	if err != nil {
+		return nil, err
+	}
+	return hasher.Sum(nil), nil
+}
+
+// readAtSize is how much of a file HashLeafAt reads at once.
+// Each piece is big enough to be hashed using all CPU cores.
+const readAtSize = 16 << 20 // 16 MiB
+
+// HashLeafAt is like HashLeaf, but reads size bytes from r in large pieces.
+// The next piece is read while the current one is hashed using all CPU cores,
+// which is much faster for very large files. The hash is the same as the one
+// HashLeaf returns for the same data.
+func HashLeafAt(r io.ReaderAt, size int64, nonce Nonce) ([]byte, error) {
+	hasher := blake3.New(Blake3Size, nil)
+	hasher.Write([]byte{0x00})
+	hasher.Write(nonce)
+
+	type piece struct {
+		buf []byte
+		err error
+	}
+	// One piece being hashed, and up to two read ahead
+	const readAhead = 2
+	bufSize := min(size, readAtSize)
+	free := make(chan []byte, readAhead+1)
+	for i := 0; i < readAhead+1; i++ {
+		free <- make([]byte, bufSize)
+	}
+	full := make(chan piece, readAhead)
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		defer close(full)
+		for off := int64(0); off < size; {
+			var buf []byte
+			select {
+			case buf = <-free:
+			case <-done:
+				return
+			}
+			buf = buf[:min(int64(len(buf)), size-off)]
+			n, err := r.ReadAt(buf, off)
+			if err == io.EOF {
+				if n == len(buf) {
+					err = nil
+				} else {
+					err = io.ErrUnexpectedEOF
+				}
+			}
+			select {
+			case full <- piece{buf[:n], err}:
+			case <-done:
+				return
+			}
+			if err != nil {
+				return
+			}
+			off += int64(n)
+		}
+	}()
+
+	for p := range full {
+		if p.err != nil {
+			return nil, p.err
+		}
+		hasher.Write(p.buf)
+		free <- p.buf[:cap(p.buf)]
+	}
+	return hasher.Sum(nil), nil
+}
+
+// newNonce returns the provided nonce, or a random one if it's nil.
+func newNonce(nonce Nonce) (Nonce, error) {
+	if nonce != nil {
+		return nonce, nil
+	}
+	nonce = make(Nonce, NonceSize)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return nonce, nil
+}
+
 // CreateLeaf creates a leaf node.
 // A random nonce is generated and used if the provided one is nil.
 // The only possible errors are ones returned from the io.Reader, or those
 // raised during random number generation.
 func CreateLeaf(name string, r io.Reader, nonce Nonce) (*Node, error) {
-	if nonce == nil {
-		nonce = make(Nonce, NonceSize)
-		_, err := rand.Read(nonce)
-		if err != nil {
-			return nil, err
-		}
+	nonce, err := newNonce(nonce)
+	if err != nil {
+		return nil, err
 	}
 	hash, err := HashLeaf(r, nonce)
 	if err != nil {
@@ -89,6 +187,75 @@ func CreateLeaf(name string, r io.Reader, nonce Nonce) (*Node, error) {
 	}, nil
 }
 
+// CreateLeafBuffer is like CreateLeaf, but uses HashLeafBuffer to read r with buf.
+func CreateLeafBuffer(name string, r io.Reader, nonce Nonce, buf []byte) (*Node, error) {
+	nonce, err := newNonce(nonce)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := HashLeafBuffer(r, nonce, buf)
+	if err != nil {
+		return nil, err
+	}
+	return &Node{
+		Name:  name,
+		Hash:  hash,
+		Nonce: nonce,
+	}, nil
+}
+
+// CreateLeafAt is like CreateLeaf, but uses HashLeafAt to hash size bytes of r.
+func CreateLeafAt(name string, r io.ReaderAt, size int64, nonce Nonce) (*Node, error) {
+	nonce, err := newNonce(nonce)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := HashLeafAt(r, size, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return &Node{
+		Name:  name,
+		Hash:  hash,
+		Nonce: nonce,
+	}, nil
+}
+
+// Depth returns the number of levels in the tree this node is the root of,
+// counting the root and the leaves. The trees of directory leaves are included.
+func (n *Node) Depth() int {
+	if n.Dir != nil {
+		return 1 + n.Dir.Depth()
+	}
+	if n.Left == nil || n.Right == nil {
+		return 1
+	}
+	return 1 + max(n.Left.Depth(), n.Right.Depth())
+}
+
+// HashDirLeaf returns the leaf hash of a directory in a hierarchical tree,
+// given the root hash of the directory's own tree.
+//
+// The 0x02 prefix keeps directory leaves apart from file leaves and interior
+// nodes. Otherwise the root hash of any subtree could be passed off as a
+// directory, with a proof that claims a smaller tree.
+func HashDirLeaf(rootHash []byte) []byte {
+	hasher := blake3.New(Blake3Size, nil)
+	hasher.Write([]byte{0x02})
+	hasher.Write(rootHash)
+	return hasher.Sum(nil)
+}
+
+// CreateDirLeaf creates the leaf for a directory in a hierarchical tree, whose
+// own tree has the given root.
+func CreateDirLeaf(name string, root *Node) *Node {
+	return &Node{
+		Name: name,
+		Hash: HashDirLeaf(root.Hash),
+		Dir:  root,
+	}
+}
+
 // CreateTree create a Merkle tree from the given leaves.
 // Leaves are used in the provided order. The root node of the newly-formed
 // tree is returned.
@@ -217,6 +384,77 @@ func GetLeaf(root *Node, n, m uint64) (*Node, error) {
 	}
 }
 
+// ProofNodes finds the nodes an inclusion proof uses in the given tree. The
+// path goes from the root down to the proven leaf, through the leaves and roots
+// of any directories on the way, and the siblings are the
+// nodes whose hashes make up the proof, in the same bottom-to-top order. For
+// proofs with parents, root is the root of the outermost tree.
+//
+// An error is returned if the proof doesn't match the tree.
+func ProofNodes(root *Node, proof *InclusionProof) (path, siblings []*Node, err error) {
+	// Walk from the outermost tree in, each leaf being the root of the next
+	levels := []*InclusionProof{proof}
+	for _, parent := range proof.Parents {
+		if parent == nil {
+			return nil, nil, errors.New("proof is missing a level")
+		}
+		levels = append([]*InclusionProof{parent}, levels...)
+	}
+	node := root
+	for _, l := range levels {
+		p, s, err := proofNodes(node, l.TreeSize, l.LeafIndex)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(s) != len(l.Proof) {
+			return nil, nil, errors.New("proof doesn't match the tree")
+		}
+		for i := range s {
+			if !bytes.Equal(s[i].Hash, l.Proof[i]) {
+				return nil, nil, errors.New("proof doesn't match the tree")
+			}
+		}
+		path = append(path, p...)
+		siblings = append(s, siblings...)
+		node = p[len(p)-1]
+		if l != proof {
+			// The leaf is a directory, whose tree is the next level. Its root
+			// starts the path of that level.
+			if node.Dir == nil {
+				return nil, nil, errors.New("proof doesn't match the tree")
+			}
+			node = node.Dir
+		}
+	}
+	return path, siblings, nil
+}
+
+// proofNodes implements ProofNodes for a single level, with n leaves and
+// the leaf index m like GetLeaf.
+func proofNodes(root *Node, n, m uint64) (path, siblings []*Node, err error) {
+	if m >= n {
+		return nil, nil, errors.New("given leaf index is impossible")
+	}
+	if n == 1 {
+		return []*Node{root}, []*Node{}, nil
+	}
+	if root.Left == nil || root.Right == nil {
+		return nil, nil, errors.New("given number of leaves is incorrect")
+	}
+	k := flp2(n)
+	if m < k {
+		path, siblings, err = proofNodes(root.Left, k, m)
+		siblings = append(siblings, root.Right)
+	} else {
+		path, siblings, err = proofNodes(root.Right, n-k, m-k)
+		siblings = append(siblings, root.Left)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return append([]*Node{root}, path...), siblings, nil
+}
+
 // CalcInclusion proof gets the root hash for the given inclusion proof.
 //
 // The proof argument is the result of GetInclusionProof.
@@ -230,9 +468,110 @@ func CalcInclusionProof(proof *InclusionProof, reader io.Reader) ([]byte, error)
 	if err != nil {
 		return nil, err
 	}
+	return CalcInclusionProofFromHash(proof, leafHash)
+}
+
+// CalcInclusionProofFromHash works like CalcInclusionProof, but starts from an
+// already known leaf hash instead of reading the leaf data, like one from
+// HashLeaf. Only use leaf hashes you calculated yourself, or got from someone
+// you trust.
+//
+// Any parent proofs are applied in order, so the returned hash is the root of
+// the outermost tree. The root of each inner tree is a directory leaf of the
+// next one, see HashDirLeaf.
+func CalcInclusionProofFromHash(proof *InclusionProof, leafHash []byte) ([]byte, error) {
+	r, err := calcRoot(proof, leafHash)
+	if err != nil {
+		return nil, err
+	}
+	for _, parent := range proof.Parents {
+		r, err = calcRoot(parent, HashDirLeaf(r))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// CalcDirInclusionProof gets the root hash for an inclusion proof of a
+// directory in a hierarchical tree, given the root hash of the directory's
+// own tree.
+func CalcDirInclusionProof(proof *InclusionProof, dirRootHash []byte) ([]byte, error) {
+	if proof != nil && len(proof.Nonce) > 0 {
+		return nil, errors.New("proof is for a file, not a directory")
+	}
+	return CalcInclusionProofFromHash(proof, HashDirLeaf(dirRootHash))
+}
 
+// ValidateProof checks that an inclusion proof is well-formed, without needing
+// the leaf: the leaf index must be within the tree, the number of hashes must be
+// what the index and tree size require, and every hash and nonce must be the
+// right size. Parent proofs are checked too. A valid proof can still be for a
+// different root hash than expected.
+func ValidateProof(proof *InclusionProof) error {
+	if err := validateLevel(proof); err != nil {
+		return err
+	}
+	if len(proof.Nonce) != 0 && len(proof.Nonce) != NonceSize {
+		return fmt.Errorf("nonce is %d bytes instead of %d", len(proof.Nonce), NonceSize)
+	}
+	for i, parent := range proof.Parents {
+		if err := validateLevel(parent); err != nil {
+			return fmt.Errorf("parent proof %d: %w", i+1, err)
+		}
+		if len(parent.Nonce) != 0 {
+			return fmt.Errorf("parent proof %d: has a nonce", i+1)
+		}
+		if len(parent.Parents) != 0 {
+			return fmt.Errorf("parent proof %d: has its own parents", i+1)
+		}
+	}
+	return nil
+}
+
+// validateLevel implements ValidateProof for a single level of a proof.
+func validateLevel(proof *InclusionProof) error {
+	if proof == nil {
+		return errors.New("proof is missing")
+	}
+	if proof.TreeSize == 0 {
+		return errors.New("tree size is zero")
+	}
+	if proof.LeafIndex >= proof.TreeSize {
+		return fmt.Errorf("leaf index %d is outside of a tree with %d leaves", proof.LeafIndex, proof.TreeSize)
+	}
+	if want := proofLength(proof.TreeSize, proof.LeafIndex); len(proof.Proof) != want {
+		return fmt.Errorf("proof has %d hashes, but leaf %d of a tree with %d leaves needs %d",
+			len(proof.Proof), proof.LeafIndex, proof.TreeSize, want)
+	}
+	for i, p := range proof.Proof {
+		if len(p) != Blake3Size {
+			return fmt.Errorf("hash %d is %d bytes instead of %d", i+1, len(p), Blake3Size)
+		}
+	}
+	return nil
+}
+
+// proofLength returns the number of hashes in the inclusion proof for leaf m of
+// a tree with n leaves, following GetInclusionProof.
+func proofLength(n, m uint64) int {
+	if n == 1 {
+		return 0
+	}
+	k := flp2(n)
+	if m < k {
+		return 1 + proofLength(k, m)
+	}
+	return 1 + proofLength(n-k, m-k)
+}
+
+// calcRoot gets the root hash for a single level of an inclusion proof.
+func calcRoot(proof *InclusionProof, leafHash []byte) ([]byte, error) {
 	// Implementing: https://datatracker.ietf.org/doc/html/rfc9162#section-2.1.3.2
 
+	if proof == nil {
+		return nil, errors.New("proof is missing a level")
+	}
 	if proof.LeafIndex >= proof.TreeSize {
 		return nil, errors.New("invalid leaf index")
 	}
@@ -271,3 +610,44 @@ func CalcInclusionProof(proof *InclusionProof, reader io.Reader) ([]byte, error)
 	}
 	return r, nil
 }
+
+// PruneTree returns a copy of the tree with only some of its leaves.
+//
+// The keep function is called for every leaf with its index, and returns the
+// node to use in its place. This is usually the leaf itself, or nil to remove it.
+// Subtrees without any remaining leaves are replaced by a node holding only
+// their hash. This means the root hash stays the same, and the remaining leaves
+// can still be found with GetLeaf and proven with GetInclusionProof.
+//
+// The argument n is the total number of leaves in the tree.
+func PruneTree(root *Node, n uint64, keep func(m uint64, leaf *Node) *Node) *Node {
+	pruned, _ := pruneTree(root, n, 0, keep)
+	return pruned
+}
+
+// pruneTree implements PruneTree for the subtree starting at the given leaf offset.
+// It also returns whether any leaves were kept.
+func pruneTree(root *Node, n, offset uint64, keep func(m uint64, leaf *Node) *Node) (*Node, bool) {
+	if n == 1 {
+		if leaf := keep(offset, root); leaf != nil {
+			return leaf, true
+		}
+		return &Node{Hash: root.Hash}, false
+	}
+	if root.Left == nil || root.Right == nil {
+		// Empty tree, or a subtree that was already pruned
+		return &Node{Hash: root.Hash}, false
+	}
+
+	k := flp2(n)
+	left, keptLeft := pruneTree(root.Left, k, offset, keep)
+	right, keptRight := pruneTree(root.Right, n-k, offset+k, keep)
+	if !keptLeft && !keptRight {
+		return &Node{Hash: root.Hash}, false
+	}
+	return &Node{
+		Hash:  root.Hash,
+		Left:  left,
+		Right: right,
+	}, true
+}
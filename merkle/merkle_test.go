@@ -0,0 +1,373 @@
+package merkle
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"lukechampine.com/blake3"
+)
+
+var testNonce = Nonce(bytes.Repeat([]byte{0xAB}, NonceSize))
+
+// testLeaves creates n leaves with different contents and fixed nonces.
+func testLeaves(t *testing.T, n int) ([]*Node, [][]byte) {
+	t.Helper()
+	leaves := make([]*Node, n)
+	data := make([][]byte, n)
+	for i := range leaves {
+		data[i] = []byte(fmt.Sprintf("file %d", i))
+		leaf, err := CreateLeaf(fmt.Sprintf("f%d", i), bytes.NewReader(data[i]), testNonce)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaves[i] = leaf
+	}
+	return leaves, data
+}
+
+func TestHashLeaf(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"short", []byte("hello")},
+		{"one chunk", bytes.Repeat([]byte{1}, 1024)},
+		{"several chunks", bytes.Repeat([]byte{2}, 5000)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := HashLeaf(bytes.NewReader(tt.data), testNonce)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := blake3.Sum256(append(append([]byte{0x00}, testNonce...), tt.data...))
+			if !bytes.Equal(got, want[:]) {
+				t.Errorf("HashLeaf = %x, want %x", got, want)
+			}
+			other, err := HashLeaf(bytes.NewReader(tt.data), bytes.Repeat([]byte{0xCD}, NonceSize))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Equal(other, got) {
+				t.Error("nonce doesn't change the hash")
+			}
+		})
+	}
+}
+
+func TestHashLeafAt(t *testing.T) {
+	const maxSize = readAtSize + 1
+	data := make([]byte, maxSize)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+
+	tests := []struct {
+		name string
+		size int
+	}{
+		{"empty", 0},
+		{"1023", 1023},
+		{"1024", 1024},
+		{"1025", 1025},
+		{"piece minus one", readAtSize - 1},
+		{"piece", readAtSize},
+		{"piece plus one", readAtSize + 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := data[:tt.size]
+			want, err := HashLeaf(bytes.NewReader(d), testNonce)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := HashLeafAt(bytes.NewReader(d), int64(tt.size), testNonce)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("HashLeafAt = %x, HashLeaf = %x", got, want)
+			}
+			got, err = HashLeafBuffer(bytes.NewReader(d), testNonce, make([]byte, 1000))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("HashLeafBuffer = %x, HashLeaf = %x", got, want)
+			}
+		})
+	}
+}
+
+func TestInclusionProof(t *testing.T) {
+	for n := 1; n <= 64; n++ {
+		leaves, data := testLeaves(t, n)
+		root := CreateTree(leaves)
+		for m := 0; m < n; m++ {
+			proof, err := GetInclusionProof(root, uint64(n), uint64(m))
+			if err != nil {
+				t.Fatalf("n=%d m=%d: %v", n, m, err)
+			}
+			if err := ValidateProof(proof); err != nil {
+				t.Errorf("n=%d m=%d: proof is invalid: %v", n, m, err)
+			}
+			if want := proofLength(uint64(n), uint64(m)); len(proof.Proof) != want {
+				t.Errorf("n=%d m=%d: proof has %d hashes, want %d", n, m, len(proof.Proof), want)
+			}
+
+			got, err := CalcInclusionProof(proof, bytes.NewReader(data[m]))
+			if err != nil {
+				t.Fatalf("n=%d m=%d: %v", n, m, err)
+			}
+			if !bytes.Equal(got, root.Hash) {
+				t.Errorf("n=%d m=%d: proof gives root %x, want %x", n, m, got, root.Hash)
+			}
+			got, err = CalcInclusionProofFromHash(proof, leaves[m].Hash)
+			if err != nil {
+				t.Fatalf("n=%d m=%d: %v", n, m, err)
+			}
+			if !bytes.Equal(got, root.Hash) {
+				t.Errorf("n=%d m=%d: proof from hash gives root %x, want %x", n, m, got, root.Hash)
+			}
+			got, err = CalcInclusionProof(proof, bytes.NewReader([]byte("other")))
+			if err != nil {
+				t.Fatalf("n=%d m=%d: %v", n, m, err)
+			}
+			if bytes.Equal(got, root.Hash) {
+				t.Errorf("n=%d m=%d: proof verified different data", n, m)
+			}
+
+			leaf, err := GetLeaf(root, uint64(n), uint64(m))
+			if err != nil {
+				t.Fatalf("n=%d m=%d: %v", n, m, err)
+			}
+			if leaf != leaves[m] {
+				t.Errorf("n=%d m=%d: GetLeaf returned %s", n, m, leaf.Name)
+			}
+		}
+	}
+}
+
+func TestValidateProof(t *testing.T) {
+	leaves, _ := testLeaves(t, 5)
+	root := CreateTree(leaves)
+	valid := func() *InclusionProof {
+		proof, err := GetInclusionProof(root, 5, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return proof
+	}
+
+	tests := []struct {
+		name   string
+		modify func(p *InclusionProof)
+	}{
+		{"zero tree size", func(p *InclusionProof) { p.TreeSize = 0 }},
+		{"leaf index outside tree", func(p *InclusionProof) { p.LeafIndex = 5 }},
+		{"missing hash", func(p *InclusionProof) { p.Proof = p.Proof[1:] }},
+		{"extra hash", func(p *InclusionProof) { p.Proof = append(p.Proof, p.Proof[0]) }},
+		{"short hash", func(p *InclusionProof) { p.Proof[0] = p.Proof[0][1:] }},
+		{"short nonce", func(p *InclusionProof) { p.Nonce = p.Nonce[1:] }},
+		{"nil parent", func(p *InclusionProof) { p.Parents = []*InclusionProof{nil} }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proof := valid()
+			tt.modify(proof)
+			if err := ValidateProof(proof); err == nil {
+				t.Error("ValidateProof succeeded")
+			}
+		})
+	}
+}
+
+// TestDirProof checks proofs through a directory leaf, like in a hierarchical tree.
+func TestDirProof(t *testing.T) {
+	inner, _ := testLeaves(t, 3)
+	innerRoot := CreateTree(inner)
+	outer, _ := testLeaves(t, 3)
+	outer[1] = CreateDirLeaf("dir", innerRoot)
+	root := CreateTree(outer)
+
+	proof, err := GetInclusionProof(innerRoot, 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent, err := GetInclusionProof(root, 3, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent.Nonce = nil
+	proof.Parents = []*InclusionProof{parent}
+	if err := ValidateProof(proof); err != nil {
+		t.Fatalf("proof is invalid: %v", err)
+	}
+
+	got, err := CalcInclusionProofFromHash(proof, inner[2].Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, root.Hash) {
+		t.Errorf("file proof gives root %x, want %x", got, root.Hash)
+	}
+	got, err = CalcDirInclusionProof(parent, innerRoot.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, root.Hash) {
+		t.Errorf("directory proof gives root %x, want %x", got, root.Hash)
+	}
+	// A directory root used as a plain leaf must not verify
+	got, err = CalcInclusionProofFromHash(parent, innerRoot.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(got, root.Hash) {
+		t.Error("directory root verified as a leaf hash")
+	}
+	if _, err := CalcDirInclusionProof(proof, innerRoot.Hash); err == nil {
+		t.Error("CalcDirInclusionProof accepted a file proof")
+	}
+}
+
+// TestDirLeaf checks that a directory with one file doesn't have the same
+// leaf as the file.
+func TestDirLeaf(t *testing.T) {
+	leaves, _ := testLeaves(t, 1)
+	dir := CreateDirLeaf("dir", CreateTree(leaves))
+	if bytes.Equal(dir.Hash, leaves[0].Hash) {
+		t.Error("directory leaf has the same hash as its only file")
+	}
+}
+
+func TestPruneTree(t *testing.T) {
+	for n := 1; n <= 64; n++ {
+		leaves, _ := testLeaves(t, n)
+		root := CreateTree(leaves)
+		for m := 0; m < n; m++ {
+			pruned := PruneTree(root, uint64(n), func(i uint64, leaf *Node) *Node {
+				if i == uint64(m) {
+					return leaf
+				}
+				return nil
+			})
+			if !bytes.Equal(pruned.Hash, root.Hash) {
+				t.Fatalf("n=%d m=%d: pruned root is %x, want %x", n, m, pruned.Hash, root.Hash)
+			}
+			leaf, err := GetLeaf(pruned, uint64(n), uint64(m))
+			if err != nil {
+				t.Fatalf("n=%d m=%d: %v", n, m, err)
+			}
+			if leaf != leaves[m] {
+				t.Errorf("n=%d m=%d: kept leaf is missing", n, m)
+			}
+			want, err := GetInclusionProof(root, uint64(n), uint64(m))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := GetInclusionProof(pruned, uint64(n), uint64(m))
+			if err != nil {
+				t.Fatalf("n=%d m=%d: %v", n, m, err)
+			}
+			if len(got.Proof) != len(want.Proof) {
+				t.Fatalf("n=%d m=%d: pruned proof has %d hashes, want %d", n, m, len(got.Proof), len(want.Proof))
+			}
+			for i := range got.Proof {
+				if !bytes.Equal(got.Proof[i], want.Proof[i]) {
+					t.Errorf("n=%d m=%d: pruned proof hash %d differs", n, m, i)
+				}
+			}
+			if n > 1 {
+				other := (m + 1) % n
+				if leaf, err := GetLeaf(pruned, uint64(n), uint64(other)); err == nil && len(leaf.Name) > 0 {
+					t.Errorf("n=%d m=%d: leaf %d wasn't pruned", n, m, other)
+				}
+			}
+		}
+	}
+}
+
+func TestProofNodes(t *testing.T) {
+	for n := 1; n <= 64; n++ {
+		leaves, _ := testLeaves(t, n)
+		root := CreateTree(leaves)
+		for m := 0; m < n; m++ {
+			proof, err := GetInclusionProof(root, uint64(n), uint64(m))
+			if err != nil {
+				t.Fatal(err)
+			}
+			path, siblings, err := ProofNodes(root, proof)
+			if err != nil {
+				t.Fatalf("n=%d m=%d: %v", n, m, err)
+			}
+			if path[0] != root || path[len(path)-1] != leaves[m] {
+				t.Errorf("n=%d m=%d: path doesn't go from the root to the leaf", n, m)
+			}
+			if len(siblings) != len(proof.Proof) {
+				t.Fatalf("n=%d m=%d: %d siblings for %d proof hashes", n, m, len(siblings), len(proof.Proof))
+			}
+			for i := range siblings {
+				if !bytes.Equal(siblings[i].Hash, proof.Proof[i]) {
+					t.Errorf("n=%d m=%d: sibling %d doesn't match the proof", n, m, i)
+				}
+			}
+		}
+	}
+
+	leaves, _ := testLeaves(t, 4)
+	root := CreateTree(leaves)
+	proof, err := GetInclusionProof(root, 4, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proof.Proof[0] = proof.Proof[1]
+	if _, _, err := ProofNodes(root, proof); err == nil {
+		t.Error("ProofNodes accepted a proof that doesn't match the tree")
+	}
+}
+
+// TestDirProofNodes checks that paths go through directory leaves and roots.
+func TestDirProofNodes(t *testing.T) {
+	inner, _ := testLeaves(t, 3)
+	innerRoot := CreateTree(inner)
+	outer, _ := testLeaves(t, 3)
+	dirLeaf := CreateDirLeaf("dir", innerRoot)
+	outer[1] = dirLeaf
+	root := CreateTree(outer)
+
+	proof, err := GetInclusionProof(innerRoot, 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent, err := GetInclusionProof(root, 3, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent.Nonce = nil
+	proof.Parents = []*InclusionProof{parent}
+
+	path, _, err := ProofNodes(root, proof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*Node{dirLeaf, innerRoot, inner[2]}
+	if len(path) < len(want) {
+		t.Fatalf("path has %d nodes", len(path))
+	}
+	for i, n := range path[len(path)-len(want):] {
+		if n != want[i] {
+			t.Errorf("path node %d is %q, want %q", i, n.Name, want[i].Name)
+		}
+	}
+
+	proof.Parents = []*InclusionProof{nil}
+	if _, err := CalcInclusionProofFromHash(proof, inner[2].Hash); err == nil {
+		t.Error("CalcInclusionProofFromHash accepted a nil parent")
+	}
+	if _, _, err := ProofNodes(root, proof); err == nil {
+		t.Error("ProofNodes accepted a nil parent")
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/makew0rld/merkdir/tree"
+	"github.com/schollz/progressbar/v3"
+	"golang.org/x/term"
+)
+
+// Ways to show progress while hashing
+const (
+	progressBar  = "bar"  // Progress bar, for terminals
+	progressLog  = "log"  // Periodic lines of text, for log files
+	progressJSON = "json" // Periodic JSON objects, one per line, for other programs
+	progressNone = "none" // Only the summary at the end
+)
+
+// logInterval is how often the log and json modes report progress.
+var logInterval = map[string]time.Duration{
+	progressLog:  10 * time.Second,
+	progressJSON: time.Second,
+}
+
+// newProgress returns a tree.Progress for the given mode, and where status
+// messages should be written. All output goes to stderr, so that stdout only
+// has results. An empty mode picks the bar for terminals and log otherwise.
+func newProgress(mode string) (tree.Progress, io.Writer) {
+	if len(mode) == 0 {
+		mode = progressLog
+		if term.IsTerminal(int(os.Stderr.Fd())) {
+			mode = progressBar
+		}
+	}
+	switch mode {
+	case progressBar:
+		return &barProgress{}, os.Stderr
+	case progressJSON:
+		jp := &jsonProgress{enc: json.NewEncoder(os.Stderr)}
+		return jp, jp
+	default:
+		return &textProgress{mode: mode}, os.Stderr
+	}
+}
+
+// progressStats tracks how much hashing is done.
+type progressStats struct {
+	mu          sync.Mutex
+	start       time.Time
+	lastReport  time.Time
+	files       int
+	filesDone   int // Including files that couldn't be read
+	filesFailed int // Files that couldn't be read
+	bytes       int64
+	bytesDone   int64
+}
+
+func (ps *progressStats) Start(files int, totalBytes int64) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.start = time.Now()
+	ps.lastReport = ps.start
+	ps.files = files
+	ps.bytes = totalBytes
+}
+
+// add counts hashed bytes, and reports whether it's time to report progress
+// again given the interval.
+func (ps *progressStats) add(n int, interval time.Duration) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.bytesDone += int64(n)
+	if interval == 0 || time.Since(ps.lastReport) < interval {
+		return false
+	}
+	ps.lastReport = time.Now()
+	return true
+}
+
+func (ps *progressStats) FileDone(name string, err error) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.filesDone++
+	if err != nil {
+		ps.filesFailed++
+	}
+}
+
+// rate returns the bytes hashed per second so far.
+func (ps *progressStats) rate() float64 {
+	elapsed := time.Since(ps.start).Seconds()
+	if elapsed == 0 {
+		return 0
+	}
+	return float64(ps.bytesDone) / elapsed
+}
+
+// eta estimates how long hashing will take to finish, or returns -1 if it
+// can't be estimated yet.
+func (ps *progressStats) eta() time.Duration {
+	rate := ps.rate()
+	if rate == 0 {
+		return -1
+	}
+	return time.Duration(float64(ps.bytes-ps.bytesDone) / rate * float64(time.Second))
+}
+
+// summary describes how hashing went, once it's finished.
+func (ps *progressStats) summary() string {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return fmt.Sprintf("Hashed %d files (%s) in %s, %s/s", ps.filesDone-ps.filesFailed, formatBytes(float64(ps.bytesDone)),
+		time.Since(ps.start).Round(time.Millisecond), formatBytes(ps.rate()))
+}
+
+// barProgress shows hashing progress as a progress bar of bytes read.
+type barProgress struct {
+	progressStats
+	bar *progressbar.ProgressBar
+}
+
+func (bp *barProgress) Start(files int, totalBytes int64) {
+	bp.progressStats.Start(files, totalBytes)
+	// Same as progressbar.DefaultBytes, but on stderr
+	bp.bar = progressbar.NewOptions64(totalBytes,
+		progressbar.OptionSetWriter(os.Stderr),
+		progressbar.OptionShowBytes(true),
+		progressbar.OptionSetWidth(10),
+		progressbar.OptionThrottle(65*time.Millisecond),
+		progressbar.OptionShowCount(),
+		progressbar.OptionOnCompletion(func() { fmt.Fprint(os.Stderr, "\n") }),
+		progressbar.OptionSpinnerType(14),
+		progressbar.OptionFullWidth(),
+		progressbar.OptionSetRenderBlankState(true),
+	)
+}
+
+func (bp *barProgress) Add(n int) {
+	bp.add(n, 0)
+	bp.bar.Add(n)
+}
+
+func (bp *barProgress) Finish() {
+	bp.bar.Finish()
+	fmt.Fprintln(os.Stderr, bp.summary())
+}
+
+// endProgress stops showing progress once hashing has failed or been
+// interrupted, so the error is printed on a line of its own.
+func endProgress(p tree.Progress) {
+	if bp, ok := p.(*barProgress); ok && bp.bar != nil && !bp.bar.IsFinished() {
+		bp.bar.Exit()
+	}
+}
+
+// textProgress prints lines of text about hashing progress, for the log mode.
+// With the none mode only the summary is printed.
+type textProgress struct {
+	progressStats
+	mode string
+}
+
+func (tp *textProgress) Add(n int) {
+	if !tp.add(n, logInterval[tp.mode]) {
+		return
+	}
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	line := fmt.Sprintf("Progress: %d/%d files, %s/%s, %s/s", tp.filesDone, tp.files,
+		formatBytes(float64(tp.bytesDone)), formatBytes(float64(tp.bytes)), formatBytes(tp.rate()))
+	if eta := tp.eta(); eta >= 0 {
+		line += fmt.Sprintf(", ETA %s", eta.Round(time.Second))
+	}
+	fmt.Fprintln(os.Stderr, line)
+}
+
+func (tp *textProgress) Finish() {
+	fmt.Fprintln(os.Stderr, tp.summary())
+}
+
+// jsonProgress writes hashing progress and status messages as JSON objects,
+// one per line.
+type jsonProgress struct {
+	progressStats
+	enc   *json.Encoder
+	encMu sync.Mutex
+}
+
+// progressEvent is one line of output from the json mode.
+type progressEvent struct {
+	Event     string  `json:"event"` // start, progress, finish, or log
+	Message   string  `json:"message,omitempty"`
+	Files     int     `json:"files"`
+	FilesDone int     `json:"files_done"`
+	Bytes     int64   `json:"bytes"`
+	BytesDone int64   `json:"bytes_done"`
+	Rate      float64 `json:"rate"`         // Bytes per second
+	ETA       float64 `json:"eta"`          // Seconds, -1 if unknown
+	Elapsed   float64 `json:"elapsed_time"` // Seconds
+}
+
+func (jp *jsonProgress) emit(event, message string) {
+	jp.mu.Lock()
+	e := progressEvent{
+		Event:     event,
+		Message:   message,
+		Files:     jp.files,
+		FilesDone: jp.filesDone,
+		Bytes:     jp.bytes,
+		BytesDone: jp.bytesDone,
+		Rate:      jp.rate(),
+		ETA:       -1,
+	}
+	if eta := jp.eta(); eta >= 0 {
+		e.ETA = eta.Seconds()
+	}
+	if !jp.start.IsZero() {
+		e.Elapsed = time.Since(jp.start).Seconds()
+	}
+	jp.mu.Unlock()
+
+	jp.encMu.Lock()
+	defer jp.encMu.Unlock()
+	jp.enc.Encode(e)
+}
+
+func (jp *jsonProgress) Start(files int, totalBytes int64) {
+	jp.progressStats.Start(files, totalBytes)
+	jp.emit("start", "")
+}
+
+func (jp *jsonProgress) Add(n int) {
+	if jp.add(n, logInterval[progressJSON]) {
+		jp.emit("progress", "")
+	}
+}
+
+func (jp *jsonProgress) Finish() {
+	jp.emit("finish", jp.summary())
+}
+
+// Write turns status messages into log events, one per line.
+func (jp *jsonProgress) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimSuffix(string(p), "\n"), "\n") {
+		jp.emit("log", line)
+	}
+	return len(p), nil
+}
+
+// formatBytes formats a byte count for people, like "1.5 GB".
+func formatBytes(n float64) string {
+	units := []string{"B", "kB", "MB", "GB", "TB", "PB"}
+	i := 0
+	for n >= 1000 && i < len(units)-1 {
+		n /= 1000
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%.0f %s", n, units[i])
+	}
+	return fmt.Sprintf("%.1f %s", n, units[i])
+}
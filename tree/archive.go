@@ -0,0 +1,280 @@
+package tree
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+)
+
+// Archive formats, see GenOptions.ArchiveFormat
+const (
+	ArchiveZip = "zip"
+	ArchiveTar = "tar" // Can be gzipped
+)
+
+// archiveSep separates the name of an archive from the names of its members,
+// like "bundle.zip!/inner/file.txt".
+const archiveSep = "!/"
+
+// isArchive reports whether the file name has the extension of a supported archive.
+func isArchive(name string) bool {
+	name = strings.ToLower(name)
+	for _, ext := range []string{".zip", ".tar", ".tar.gz", ".tgz"} {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitArchive splits the name of an archive member into the archive name and the
+// member path inside the archive. The archive itself is named with a trailing "!",
+// which returns "." as the member path. isArchive reports which names are archives.
+func splitArchive(name string, isArchive func(string) bool) (archive, member string, ok bool) {
+	if strings.HasSuffix(name, "!") && isArchive(name[:len(name)-1]) {
+		return name[:len(name)-1], ".", true
+	}
+	for i := strings.Index(name, archiveSep); i != -1; {
+		if isArchive(name[:i]) {
+			return name[:i], name[i+len(archiveSep):], true
+		}
+		j := strings.Index(name[i+1:], archiveSep)
+		if j == -1 {
+			break
+		}
+		i += j + 1
+	}
+	return "", "", false
+}
+
+// archiveFS is an archive opened as a filesystem.
+type archiveFS interface {
+	fs.FS
+	io.Closer
+}
+
+// archiveFormat returns the format of an opened archive.
+func archiveFormat(fsys archiveFS) string {
+	if _, ok := fsys.(*zipFS); ok {
+		return ArchiveZip
+	}
+	return ArchiveTar
+}
+
+// openArchive opens the named zip or tar file in fsys. Tar files can be
+// compressed with gzip. The format is detected from the file contents.
+func openArchive(fsys fs.FS, name string) (archiveFS, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	var magic [4]byte
+	n, _ := io.ReadFull(f, magic[:])
+	isGzip := n >= 2 && bytes.Equal(magic[:2], []byte{0x1f, 0x8b})
+
+	// Archives need random access to be read without loading them into memory.
+	// Files that don't support it, or are compressed, are copied to a temporary file.
+	ra, ok := f.(io.ReaderAt)
+	size := fi.Size()
+	closeFn := f.Close
+	if !ok || isGzip {
+		f.Close()
+		if f, err = fsys.Open(name); err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		var r io.Reader = f
+		if isGzip {
+			gzr, err := gzip.NewReader(f)
+			if err != nil {
+				return nil, err
+			}
+			r = gzr
+		}
+		temp, err := os.CreateTemp("", "merkdir-*")
+		if err != nil {
+			return nil, err
+		}
+		closeFn = func() error {
+			temp.Close()
+			return os.Remove(temp.Name())
+		}
+		size, err = io.Copy(temp, r)
+		if err != nil {
+			closeFn()
+			return nil, err
+		}
+		ra = temp
+		if isGzip {
+			// Only tar files are supported inside gzip
+			magic = [4]byte{}
+		}
+	}
+
+	if bytes.Equal(magic[:], []byte("PK\x03\x04")) || bytes.Equal(magic[:], []byte("PK\x05\x06")) {
+		zr, err := zip.NewReader(ra, size)
+		if err != nil {
+			closeFn()
+			return nil, err
+		}
+		return &zipFS{zr, closeFn}, nil
+	}
+	tfs := &tarFS{ra: ra, size: size, closeFn: closeFn}
+	if err := tfs.index(); err != nil {
+		tfs.Close()
+		return nil, err
+	}
+	return tfs, nil
+}
+
+// zipFS is a zip file that can be closed.
+type zipFS struct {
+	*zip.Reader
+	closeFn func() error
+}
+
+func (z *zipFS) Close() error { return z.closeFn() }
+
+// tarFS is a read-only fs.FS for a tar file. File data is read directly from the
+// archive, so it can be used concurrently.
+type tarFS struct {
+	ra      io.ReaderAt
+	size    int64
+	closeFn func() error
+	entries map[string]*tarEntry
+}
+
+// tarEntry is a file or directory in a tar archive.
+// Directories that only exist implicitly through member paths are included.
+type tarEntry struct {
+	info     fs.FileInfo
+	offset   int64
+	children []string // Names of entries in a directory
+}
+
+// index finds where each member's data starts in the archive.
+func (tfs *tarFS) index() error {
+	sr := io.NewSectionReader(tfs.ra, 0, tfs.size)
+	tr := tar.NewReader(sr)
+	tfs.entries = map[string]*tarEntry{
+		".": {info: dirInfoFor(".")},
+	}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name := path.Clean(strings.TrimPrefix(hdr.Name, "/"))
+		if !fs.ValidPath(name) || name == "." {
+			// Unsafe or unusable name
+			continue
+		}
+		offset, err := sr.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		e := &tarEntry{info: hdr.FileInfo(), offset: offset}
+		if old, ok := tfs.entries[name]; ok {
+			// Later files replace earlier ones with the same name
+			if !old.info.IsDir() && !e.info.IsDir() {
+				*old = *e
+			}
+			continue
+		}
+		tfs.add(name, e)
+	}
+	return nil
+}
+
+// add adds the entry to its parent directory, creating parents as needed.
+func (tfs *tarFS) add(name string, e *tarEntry) {
+	tfs.entries[name] = e
+	parent := path.Dir(name)
+	if _, ok := tfs.entries[parent]; !ok {
+		tfs.add(parent, &tarEntry{info: dirInfoFor(parent)})
+	}
+	tfs.entries[parent].children = append(tfs.entries[parent].children, name)
+}
+
+// dirInfoFor returns file info for a directory that only exists implicitly.
+func dirInfoFor(name string) fs.FileInfo {
+	hdr := &tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     name,
+		Mode:     0755,
+	}
+	return hdr.FileInfo()
+}
+
+func (tfs *tarFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	e, ok := tfs.entries[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	if e.info.IsDir() {
+		return &tarDir{fs: tfs, entry: e}, nil
+	}
+	return &tarFile{
+		entry:         e,
+		SectionReader: io.NewSectionReader(tfs.ra, e.offset, e.info.Size()),
+	}, nil
+}
+
+func (tfs *tarFS) Close() error { return tfs.closeFn() }
+
+type tarFile struct {
+	*io.SectionReader
+	entry *tarEntry
+}
+
+func (f *tarFile) Stat() (fs.FileInfo, error) { return f.entry.info, nil }
+func (f *tarFile) Close() error               { return nil }
+
+type tarDir struct {
+	fs    *tarFS
+	entry *tarEntry
+	pos   int
+}
+
+func (d *tarDir) Stat() (fs.FileInfo, error) { return d.entry.info, nil }
+func (d *tarDir) Close() error               { return nil }
+
+func (d *tarDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.entry.info.Name(), Err: errors.New("is a directory")}
+}
+
+func (d *tarDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.entry.children[d.pos:]
+	if n > 0 {
+		if len(rest) == 0 {
+			return nil, io.EOF
+		}
+		if n < len(rest) {
+			rest = rest[:n]
+		}
+	}
+	d.pos += len(rest)
+	entries := make([]fs.DirEntry, len(rest))
+	for i, name := range rest {
+		entries[i] = fs.FileInfoToDirEntry(d.fs.entries[name].info)
+	}
+	return entries, nil
+}
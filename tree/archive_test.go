@@ -0,0 +1,208 @@
+package tree
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+)
+
+func TestSplitArchive(t *testing.T) {
+	tests := []struct {
+		name    string
+		archive string
+		member  string
+		ok      bool
+	}{
+		{"bundle.zip!/a.txt", "bundle.zip", "a.txt", true},
+		{"sub/bundle.zip!/deep/a.txt", "sub/bundle.zip", "deep/a.txt", true},
+		{"bundle.zip!", "bundle.zip", ".", true},
+		{"odd!/name.tar!/a.txt", "odd!/name.tar", "a.txt", true},
+		{"outer.zip!/inner.tgz!/a.txt", "outer.zip", "inner.tgz!/a.txt", true},
+		{"notes.txt!/a.txt", "", "", false},
+		{"bundle.zip", "", "", false},
+		{"wow!", "", "", false},
+	}
+	for _, tt := range tests {
+		archive, member, ok := splitArchive(tt.name, isArchive)
+		if archive != tt.archive || member != tt.member || ok != tt.ok {
+			t.Errorf("splitArchive(%q) = %q, %q, %v, want %q, %q, %v",
+				tt.name, archive, member, ok, tt.archive, tt.member, tt.ok)
+		}
+	}
+}
+
+// archiveFiles are the members of the test archives, without any directories.
+var archiveFiles = map[string]string{
+	"top.txt":         "top",
+	"a/b/c.txt":       "deep",
+	"a/d.txt":         "shallow",
+	"other/empty.txt": "",
+}
+
+func makeTar(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for name, content := range files {
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func makeZip(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func gzipData(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestOpenArchive(t *testing.T) {
+	tarData := makeTar(t, archiveFiles)
+	fsys := fstest.MapFS{
+		"files.tar": {Data: tarData},
+		// Detected from the contents, not the name
+		"files.tgz.bin": {Data: gzipData(t, tarData)},
+		"files.zip":     {Data: makeZip(t, archiveFiles)},
+	}
+	tests := []struct {
+		name   string
+		format string
+	}{
+		{"files.tar", ArchiveTar},
+		{"files.tgz.bin", ArchiveTar},
+		{"files.zip", ArchiveZip},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			afs, err := openArchive(fsys, tt.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer afs.Close()
+			if format := archiveFormat(afs); format != tt.format {
+				t.Errorf("format is %s, want %s", format, tt.format)
+			}
+			for name, content := range archiveFiles {
+				data, err := fs.ReadFile(afs, name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(data) != content {
+					t.Errorf("%s has %q, want %q", name, data, content)
+				}
+			}
+			if tt.format == ArchiveTar {
+				// Checks directories too, which aren't in the archive
+				if err := fstest.TestFS(afs, "top.txt", "a/b/c.txt", "a/d.txt", "other/empty.txt"); err != nil {
+					t.Error(err)
+				}
+			}
+		})
+	}
+}
+
+// TestTarNames checks that unsafe names are left out, and that later members
+// replace earlier ones with the same name.
+func TestTarNames(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, m := range []struct{ name, content string }{
+		{"/abs.txt", "abs"},
+		{"../escape.txt", "escape"},
+		{"dup.txt", "old"},
+		{"./dup.txt", "new"},
+	} {
+		hdr := &tar.Header{Name: m.name, Mode: 0644, Size: int64(len(m.content)), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(m.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	afs, err := openArchive(fstest.MapFS{"x.tar": {Data: buf.Bytes()}}, "x.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer afs.Close()
+	if err := fstest.TestFS(afs, "abs.txt", "dup.txt"); err != nil {
+		t.Error(err)
+	}
+	if _, err := afs.Open("escape.txt"); err == nil {
+		t.Error("member outside the archive root was kept")
+	}
+	if data, err := fs.ReadFile(afs, "dup.txt"); err != nil || string(data) != "new" {
+		t.Errorf("dup.txt has %q, %v, want the later member", data, err)
+	}
+}
+
+func TestExpandArchives(t *testing.T) {
+	fsys := fstest.MapFS{
+		"plain.txt":  {Data: []byte("plain")},
+		"sub/in.tgz": {Data: gzipData(t, makeTar(t, archiveFiles))},
+	}
+	tr, err := GenerateFS(context.Background(), fsys, &GenOptions{ExpandArchives: true, Dirs: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"plain.txt"}
+	for name := range archiveFiles {
+		want = append(want, "sub/in.tgz!/"+name)
+	}
+	if len(tr.Files) != len(want) {
+		t.Errorf("tree has %d files, want %d", len(tr.Files), len(want))
+	}
+	for _, name := range want {
+		if _, ok := tr.Files[name]; !ok {
+			t.Errorf("%s isn't in the tree", name)
+		}
+	}
+	for _, dir := range []string{"sub/in.tgz!", "sub/in.tgz!/a", "sub/in.tgz!/a/b"} {
+		if _, ok := tr.Dirs[dir]; !ok {
+			t.Errorf("directory %s isn't in the tree", dir)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package tree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/makew0rld/merkdir/merkle"
+)
+
+// checkpointInterval is how often progress is saved while hashing.
+const checkpointInterval = 30 * time.Second
+
+// checkpoint holds the leaves hashed so far by an unfinished gen run.
+type checkpoint struct {
+	// Settings is the tree being generated, without any files. Resuming is
+	// only possible with the same settings.
+	Settings *Tree
+	Leaves   map[string]*checkpointLeaf
+}
+
+// checkpointLeaf is a hashed file, along with what's needed to tell if it
+// changed since.
+type checkpointLeaf struct {
+	Size    int64
+	ModTime int64 // Unix nanoseconds, as CBOR times only keep seconds
+	Nonce   merkle.Nonce
+	Hash    []byte
+	Digest  []byte // Unsalted, see FileMeta
+}
+
+// treeSettings returns a copy of the tree with only the fields that decide
+// which files are in it and how they are hashed.
+func treeSettings(t *Tree) *Tree {
+	return &Tree{
+		Path:           t.Path,
+		Archive:        t.Archive,
+		Filter:         t.Filter,
+		Symlinks:       t.Symlinks,
+		Roots:          t.Roots,
+		ExpandArchives: t.ExpandArchives,
+		Mode:           t.Mode,
+		NoDigests:      t.NoDigests,
+	}
+}
+
+func newCheckpoint(t *Tree) *checkpoint {
+	return &checkpoint{
+		Settings: treeSettings(t),
+		Leaves:   make(map[string]*checkpointLeaf),
+	}
+}
+
+// add records a hashed file.
+func (c *checkpoint) add(leaf *merkle.Node, digest []byte, stat fileStat) {
+	c.Leaves[leaf.Name] = &checkpointLeaf{
+		Size:    stat.size,
+		ModTime: stat.modTime.UnixNano(),
+		Nonce:   leaf.Nonce,
+		Hash:    leaf.Hash,
+		Digest:  digest,
+	}
+}
+
+// leaf returns the stored leaf and content digest for the named file, or nil
+// if it wasn't hashed or has changed since.
+func (c *checkpoint) leaf(name string, stat fileStat) (*merkle.Node, []byte) {
+	cl, ok := c.Leaves[name]
+	if !ok || cl.Size != stat.size || cl.ModTime != stat.modTime.UnixNano() ||
+		(cl.Digest == nil && !c.Settings.NoDigests) {
+		return nil, nil
+	}
+	return &merkle.Node{Name: name, Hash: cl.Hash, Nonce: cl.Nonce}, cl.Digest
+}
+
+// write saves the checkpoint to path, replacing the previous one only once
+// the new one is complete.
+func (c *checkpoint) write(path string) error {
+	return writeAtomic(path, 0600, false, func(w io.Writer) error {
+		return cbor.NewEncoder(w).Encode(c)
+	})
+}
+
+// readCheckpoint loads the checkpoint at path, checking it was made for a tree
+// with the same settings as t. If there is no file at path, an empty
+// checkpoint is returned.
+func readCheckpoint(path string, t *Tree) (*checkpoint, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return newCheckpoint(t), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var c checkpoint
+	if err := cbor.NewDecoder(f).Decode(&c); err != nil {
+		return nil, fmt.Errorf("error reading or decoding checkpoint: %w", err)
+	}
+
+	// Compare canonical encodings, since the settings hold maps
+	em, err := cbor.CanonicalEncOptions().EncMode()
+	if err != nil {
+		return nil, err
+	}
+	have, err := em.Marshal(treeSettings(c.Settings))
+	if err != nil {
+		return nil, err
+	}
+	want, err := em.Marshal(treeSettings(t))
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(have, want) {
+		return nil, errors.New("checkpoint was made with different paths or options, so it can't be resumed")
+	}
+	if c.Leaves == nil {
+		c.Leaves = make(map[string]*checkpointLeaf)
+	}
+	return &c, nil
+}
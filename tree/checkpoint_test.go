@@ -0,0 +1,126 @@
+package tree
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/makew0rld/merkdir/merkle"
+)
+
+func TestCheckpointLeaf(t *testing.T) {
+	c := newCheckpoint(&Tree{})
+	modTime := time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC)
+	leaf := &merkle.Node{Name: "a.txt", Hash: []byte{1}, Nonce: merkle.Nonce{2}}
+	c.add(leaf, []byte{3}, fileStat{size: 10, modTime: modTime})
+
+	tests := []struct {
+		name  string
+		file  string
+		stat  fileStat
+		reuse bool
+	}{
+		{"unchanged", "a.txt", fileStat{size: 10, modTime: modTime}, true},
+		{"other device", "a.txt", fileStat{size: 10, modTime: modTime, device: 7}, true},
+		{"size", "a.txt", fileStat{size: 11, modTime: modTime}, false},
+		{"mod time", "a.txt", fileStat{size: 10, modTime: modTime.Add(time.Nanosecond)}, false},
+		{"not hashed", "b.txt", fileStat{size: 10, modTime: modTime}, false},
+	}
+	for _, tt := range tests {
+		got, digest := c.leaf(tt.file, tt.stat)
+		if !tt.reuse {
+			if got != nil {
+				t.Errorf("%s: leaf was reused", tt.name)
+			}
+			continue
+		}
+		if got == nil {
+			t.Errorf("%s: leaf wasn't reused", tt.name)
+			continue
+		}
+		if !bytes.Equal(got.Hash, leaf.Hash) || !bytes.Equal(got.Nonce, leaf.Nonce) || !bytes.Equal(digest, []byte{3}) {
+			t.Errorf("%s: reused leaf is different", tt.name)
+		}
+	}
+}
+
+func TestResume(t *testing.T) {
+	dir := writeFiles(t, testFiles)
+	cpPath := filepath.Join(t.TempDir(), "checkpoint")
+	opts := &GenOptions{Paths: []string{dir}, Checkpoint: cpPath}
+	first, err := Generate(context.Background(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Same size and modification time, so the checkpoint is trusted even
+	// though the contents changed
+	same := filepath.Join(dir, "b.txt")
+	fi, err := os.Stat(same)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(same, []byte("BANANA"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(same, fi.ModTime(), fi.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	// Same size, but touched
+	touched := filepath.Join(dir, "sub", "c.txt")
+	if err := os.WriteFile(touched, []byte("CHERRY"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(touched, fi.ModTime().Add(time.Hour), fi.ModTime().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	opts.Resume = true
+	second, err := Generate(context.Background(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name := range testFiles {
+		old, err := first.Node(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, err := second.Node(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reused := bytes.Equal(leaf.Nonce, old.Nonce) && bytes.Equal(leaf.Hash, old.Hash)
+		if name == "sub/c.txt" {
+			if reused {
+				t.Errorf("%s was reused after it changed", name)
+			}
+			want, err := merkle.HashLeaf(bytes.NewReader([]byte("CHERRY")), leaf.Nonce)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(leaf.Hash, want) {
+				t.Errorf("%s wasn't hashed again", name)
+			}
+		} else if !reused {
+			t.Errorf("%s wasn't reused", name)
+		}
+	}
+
+	// Different options or roots make a checkpoint stale
+	stale := []*GenOptions{
+		{Paths: []string{dir}, Checkpoint: cpPath, Resume: true, Dirs: true},
+		{Paths: []string{dir}, Checkpoint: cpPath, Resume: true, Exclude: []string{"*.log"}},
+		{Paths: []string{dir}, Checkpoint: cpPath, Resume: true, NoDigests: true},
+		{Paths: []string{writeFiles(t, testFiles)}, Checkpoint: cpPath, Resume: true},
+		{Paths: []string{"docs=" + dir}, Checkpoint: cpPath, Resume: true},
+	}
+	for i, opts := range stale {
+		if _, err := Generate(context.Background(), opts); err == nil || !strings.Contains(err.Error(), "can't be resumed") {
+			t.Errorf("stale checkpoint %d: error is %v", i, err)
+		}
+	}
+}
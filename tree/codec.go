@@ -0,0 +1,154 @@
+package tree
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/makew0rld/merkdir/merkle"
+)
+
+// Encode writes t to w as CBOR.
+func Encode(w io.Writer, t *Tree) error {
+	return cbor.NewEncoder(w).Encode(t)
+}
+
+// Decode reads a CBOR-encoded tree from r.
+func Decode(r io.Reader) (*Tree, error) {
+	var t Tree
+	if err := cbor.NewDecoder(r).Decode(&t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// WriteFile writes t to the file at path, replacing it if it exists.
+// The file is replaced all at once, so it never holds part of a tree, even if
+// writing fails or the process is killed.
+func WriteFile(t *Tree, path string) error {
+	return writeAtomic(path, 0644, false, func(w io.Writer) error {
+		return Encode(w, t)
+	})
+}
+
+// WriteNewFile is like WriteFile, but fails with an error wrapping
+// fs.ErrExist if there is already a file at path.
+func WriteNewFile(t *Tree, path string) error {
+	return writeAtomic(path, 0644, true, func(w io.Writer) error {
+		return Encode(w, t)
+	})
+}
+
+// ReadFile reads the tree file at path.
+func ReadFile(path string) (*Tree, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Decode(f)
+}
+
+// EncodeProof writes an inclusion proof to w as CBOR.
+func EncodeProof(w io.Writer, proof *merkle.InclusionProof) error {
+	return cbor.NewEncoder(w).Encode(proof)
+}
+
+// DecodeProof reads a CBOR-encoded inclusion proof from r.
+func DecodeProof(r io.Reader) (*merkle.InclusionProof, error) {
+	var proof merkle.InclusionProof
+	if err := cbor.NewDecoder(r).Decode(&proof); err != nil {
+		return nil, err
+	}
+	return &proof, nil
+}
+
+// WriteProofFile writes an inclusion proof to the file at path, replacing it
+// if it exists. Like WriteFile, the file is replaced all at once.
+func WriteProofFile(proof *merkle.InclusionProof, path string) error {
+	return writeAtomic(path, 0644, false, func(w io.Writer) error {
+		return EncodeProof(w, proof)
+	})
+}
+
+// ReadProofFile reads the inclusion proof file at path.
+func ReadProofFile(path string) (*merkle.InclusionProof, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return DecodeProof(f)
+}
+
+// writeAtomic writes a file by writing to a temporary file in the same
+// directory, syncing it to disk, and then renaming it to path. If noClobber is
+// set, an existing file at path is never replaced.
+func writeAtomic(path string, perm fs.FileMode, noClobber bool, write func(w io.Writer) error) error {
+	dir := filepath.Dir(path)
+	f, err := createTemp(dir, perm)
+	if err != nil {
+		return err
+	}
+	tmpPath := f.Name()
+	defer os.Remove(tmpPath) // Does nothing once renamed
+
+	err = write(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if noClobber {
+		// Unlike renaming, linking fails if path already exists
+		err := os.Link(tmpPath, path)
+		if err != nil && !errors.Is(err, fs.ErrExist) {
+			// Some filesystems don't have links, so check first instead
+			if _, statErr := os.Lstat(path); statErr == nil {
+				err = fs.ErrExist
+			} else {
+				err = os.Rename(tmpPath, path)
+			}
+		}
+		if errors.Is(err, fs.ErrExist) {
+			return fmt.Errorf("not overwriting existing file %s: %w", path, fs.ErrExist)
+		}
+		if err != nil {
+			return err
+		}
+	} else if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	// Make sure the new directory entry is on disk too. Not all OSes can sync
+	// directories, so failing isn't an error.
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// createTemp is like os.CreateTemp, but the file is created with perm instead
+// of 0600, so the umask applies like for any other new file.
+func createTemp(dir string, perm fs.FileMode) (*os.File, error) {
+	for range 10000 {
+		name := filepath.Join(dir, ".merkdir-"+strconv.FormatUint(uint64(rand.Uint32()), 10)+".tmp")
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, perm)
+		if errors.Is(err, fs.ErrExist) {
+			continue
+		}
+		return f, err
+	}
+	return nil, fmt.Errorf("couldn't create temporary file in %s: %w", dir, fs.ErrExist)
+}
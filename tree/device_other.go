@@ -0,0 +1,11 @@
+//go:build !unix
+
+package tree
+
+import "io/fs"
+
+// deviceID returns 0, as devices can't be told apart on this OS. All files
+// are treated as being on the same device.
+func deviceID(fi fs.FileInfo) uint64 {
+	return 0
+}
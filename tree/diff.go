@@ -0,0 +1,92 @@
+package tree
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+)
+
+// Diff lists how the files in one tree differ from another. All names are
+// sorted.
+type Diff struct {
+	Added    []string `json:"added"`    // Files only in the newer tree
+	Removed  []string `json:"removed"`  // Files only in the older tree
+	Modified []string `json:"modified"` // Files in both, with different contents
+	Moved    []Move   `json:"moved"`    // Sorted by the new name
+}
+
+// Move is a file that has a different name in the newer tree, but the same
+// contents.
+type Move struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// Empty reports whether the trees have the same files with the same contents.
+func (d *Diff) Empty() bool {
+	return len(d.Added)+len(d.Removed)+len(d.Modified)+len(d.Moved) == 0
+}
+
+// Compare returns how the files in the to tree differ from the from tree.
+//
+// Leaf hashes can't be compared since each uses a random nonce, so the
+// content digests in Meta are used instead. Both trees need them.
+func Compare(from, to *Tree) (*Diff, error) {
+	if !from.HasDigests() || !to.HasDigests() {
+		return nil, fmt.Errorf("both trees need content digests to be compared: %w", ErrNoDigests)
+	}
+	d := &Diff{Added: []string{}, Removed: []string{}, Modified: []string{}, Moved: []Move{}}
+	for name := range to.Files {
+		if _, ok := from.Files[name]; !ok {
+			d.Added = append(d.Added, name)
+		}
+	}
+	for name := range from.Files {
+		if _, ok := to.Files[name]; !ok {
+			d.Removed = append(d.Removed, name)
+			continue
+		}
+		oldMeta, newMeta := from.Meta[name], to.Meta[name]
+		if oldMeta == nil || newMeta == nil || !bytes.Equal(oldMeta.Digest, newMeta.Digest) {
+			d.Modified = append(d.Modified, name)
+		}
+	}
+	sort.Strings(d.Added)
+	sort.Strings(d.Removed)
+	sort.Strings(d.Modified)
+
+	// Files that were removed and added with the same contents were moved.
+	// If there are several, they are paired up in name order.
+	removedByDigest := make(map[string][]string)
+	for _, name := range d.Removed {
+		if meta, ok := from.Meta[name]; ok {
+			removedByDigest[string(meta.Digest)] = append(removedByDigest[string(meta.Digest)], name)
+		}
+	}
+	moved := make(map[string]bool)
+	for _, name := range d.Added {
+		meta, ok := to.Meta[name]
+		if !ok || len(removedByDigest[string(meta.Digest)]) == 0 {
+			continue
+		}
+		candidates := removedByDigest[string(meta.Digest)]
+		d.Moved = append(d.Moved, Move{From: candidates[0], To: name})
+		removedByDigest[string(meta.Digest)] = candidates[1:]
+		moved[candidates[0]] = true
+		moved[name] = true
+	}
+	d.Added = without(d.Added, moved)
+	d.Removed = without(d.Removed, moved)
+	return d, nil
+}
+
+// without returns the names that aren't in the set.
+func without(names []string, set map[string]bool) []string {
+	kept := names[:0]
+	for _, name := range names {
+		if !set[name] {
+			kept = append(kept, name)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,124 @@
+package tree
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// digestTree creates a tree with only the parts Compare uses, with the
+// given digests by file name.
+func digestTree(digests map[string]string) *Tree {
+	names := make([]string, 0, len(digests))
+	for name := range digests {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	t := &Tree{Files: make(map[string]uint64), Meta: make(map[string]*FileMeta)}
+	for i, name := range names {
+		t.Files[name] = uint64(i)
+		t.Meta[name] = &FileMeta{Digest: []byte(digests[name])}
+	}
+	return t
+}
+
+func TestCompare(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to map[string]string
+		want     *Diff
+	}{
+		{
+			name: "same",
+			from: map[string]string{"a": "1", "b": "2"},
+			to:   map[string]string{"a": "1", "b": "2"},
+			want: &Diff{},
+		},
+		{
+			name: "added and removed",
+			from: map[string]string{"a": "1", "b": "2"},
+			to:   map[string]string{"a": "1", "c": "3"},
+			want: &Diff{Added: []string{"c"}, Removed: []string{"b"}},
+		},
+		{
+			name: "modified",
+			from: map[string]string{"a": "1", "b": "2"},
+			to:   map[string]string{"a": "1", "b": "3"},
+			want: &Diff{Modified: []string{"b"}},
+		},
+		{
+			name: "moved",
+			from: map[string]string{"a": "1", "dir/b": "2"},
+			to:   map[string]string{"a": "1", "other/b": "2"},
+			want: &Diff{Moved: []Move{{From: "dir/b", To: "other/b"}}},
+		},
+		{
+			name: "different contents aren't moves",
+			from: map[string]string{"a": "1"},
+			to:   map[string]string{"b": "2"},
+			want: &Diff{Added: []string{"b"}, Removed: []string{"a"}},
+		},
+		{
+			name: "duplicates are paired in name order",
+			from: map[string]string{"a1": "x", "a2": "x", "a3": "x"},
+			to:   map[string]string{"b1": "x", "b2": "x"},
+			want: &Diff{
+				Removed: []string{"a3"},
+				Moved:   []Move{{From: "a1", To: "b1"}, {From: "a2", To: "b2"}},
+			},
+		},
+		{
+			name: "copy of an unchanged file",
+			from: map[string]string{"a": "1"},
+			to:   map[string]string{"a": "1", "copy": "1"},
+			want: &Diff{Added: []string{"copy"}},
+		},
+		{
+			name: "modified to match a removed file",
+			from: map[string]string{"a": "1", "b": "2"},
+			to:   map[string]string{"a": "2"},
+			want: &Diff{Modified: []string{"a"}, Removed: []string{"b"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Compare(digestTree(tt.from), digestTree(tt.to))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Compare always returns empty lists rather than nil, for JSON
+			want := &Diff{
+				Added:    append([]string{}, tt.want.Added...),
+				Removed:  append([]string{}, tt.want.Removed...),
+				Modified: append([]string{}, tt.want.Modified...),
+				Moved:    append([]Move{}, tt.want.Moved...),
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %+v, want %+v", got, want)
+			}
+			if got.Empty() != want.Empty() {
+				t.Errorf("Empty() = %v", got.Empty())
+			}
+		})
+	}
+}
+
+func TestCompareNoDigests(t *testing.T) {
+	withDigests := digestTree(map[string]string{"a": "1"})
+	noDigests := digestTree(map[string]string{"a": "1"})
+	noDigests.NoDigests = true
+	noMeta := digestTree(map[string]string{"a": "1"})
+	noMeta.Meta = nil
+
+	for _, pair := range [][2]*Tree{
+		{withDigests, noDigests},
+		{noDigests, withDigests},
+		{noMeta, withDigests},
+		{withDigests, noMeta},
+	} {
+		if _, err := Compare(pair[0], pair[1]); !errors.Is(err, ErrNoDigests) {
+			t.Errorf("error is %v, want ErrNoDigests", err)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package tree
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+)
+
+// DupeGroup is a set of files in a tree with identical contents.
+type DupeGroup struct {
+	Digest []byte   `json:"digest"`
+	Size   int64    `json:"size"`  // Size of each file
+	Files  []string `json:"files"` // Sorted
+}
+
+// Wasted returns how much space is used by the extra copies.
+func (g *DupeGroup) Wasted() int64 {
+	return g.Size * int64(len(g.Files)-1)
+}
+
+// Duplicates finds files in the tree that have the same contents, using the
+// content digests. Empty files are ignored. Groups are sorted by wasted space,
+// most first.
+func (t *Tree) Duplicates() ([]*DupeGroup, error) {
+	if !t.HasDigests() {
+		return nil, fmt.Errorf("duplicates can't be found: %w", ErrNoDigests)
+	}
+	byDigest := make(map[string]*DupeGroup)
+	for name := range t.Files {
+		meta, ok := t.Meta[name]
+		if !ok || meta.Size == 0 {
+			continue
+		}
+		g, ok := byDigest[string(meta.Digest)]
+		if !ok {
+			g = &DupeGroup{Digest: meta.Digest, Size: meta.Size}
+			byDigest[string(meta.Digest)] = g
+		}
+		g.Files = append(g.Files, name)
+	}
+
+	groups := make([]*DupeGroup, 0)
+	for _, g := range byDigest {
+		if len(g.Files) < 2 {
+			continue
+		}
+		sort.Strings(g.Files)
+		groups = append(groups, g)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].Wasted() != groups[j].Wasted() {
+			return groups[i].Wasted() > groups[j].Wasted()
+		}
+		return bytes.Compare(groups[i].Digest, groups[j].Digest) < 0
+	})
+	return groups, nil
+}
@@ -0,0 +1,585 @@
+package tree
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/makew0rld/merkdir/merkle"
+	"lukechampine.com/blake3"
+)
+
+// GenOptions are the settings used to generate a tree. The zero value creates
+// a flat tree, skipping symlinks.
+type GenOptions struct {
+	// Paths are the directories and files to hash, see ParseRootArg. A single
+	// unlabeled directory is stored without a label on its file names.
+	Paths []string
+	// Archive is a zip or tar file to hash the members of instead of Paths.
+	Archive string
+	// ArchiveFormat is the format Archive must be in, one of the ArchiveFormat
+	// constants. Empty means any supported format.
+	ArchiveFormat string
+
+	Include []string // Only include files matching these globs
+	Exclude []string // Exclude files matching these gitignore-style patterns
+	// Symlink policy, one of the Symlinks constants. Empty means SymlinksSkip.
+	Symlinks string
+	// Treat zip and tar files as directories, hashing each member as a leaf
+	ExpandArchives bool
+	// Mirror the directory hierarchy, making each directory a subtree of its parent
+	Dirs bool
+	// Don't store content digests, see FileMeta. Trees without them can't be
+	// compared.
+	NoDigests bool
+
+	// Policy for files that can't be read, one of the OnError constants.
+	// Empty means OnErrorAbort. Either way, a summary is written to Log.
+	OnError string
+
+	// Number of files to hash at once. Zero means twice the number of CPUs.
+	Jobs int
+	// Number of files to read at once from each device, like a disk or
+	// network mount. Zero means no limit other than Jobs.
+	DeviceJobs int
+	// Size of reads from each file, zero uses a default.
+	BufferSize int
+	// Files at least this big are each hashed using all CPU cores, instead of
+	// one core per file. Zero means never.
+	ParallelSize int64
+
+	// Checkpoint is a file to save hashed files to while generating, so an
+	// interrupted run can be resumed. It is left in place afterwards, to be
+	// removed once the tree is saved.
+	Checkpoint string
+	// Resume skips hashing files that are stored in the checkpoint, as long as
+	// their size and modification time haven't changed.
+	Resume bool
+
+	// Details about the program generating the tree, stored in it. Optional.
+	Generator *GenInfo
+
+	Progress Progress  // Optional
+	Log      io.Writer // Optional, status messages and ignored files are written here
+}
+
+// Progress receives updates while a tree is generated. Add and FileDone are
+// called from multiple goroutines at once.
+type Progress interface {
+	// Start is called once all files are found, before hashing starts, with
+	// the number and total size of the files that need hashing.
+	Start(files int, totalBytes int64)
+	// Add is called as file data is hashed, with the number of bytes read.
+	Add(n int)
+	// FileDone is called after each file is hashed, or left out due to an
+	// error. The error is nil if the file was hashed.
+	FileDone(name string, err error)
+	// Finish is called once all files are hashed successfully.
+	Finish()
+}
+
+// progressReader reports each read to a Progress, and stops reading once the
+// context is done.
+type progressReader struct {
+	ctx context.Context
+	p   Progress
+	r   io.Reader
+}
+
+func (pr *progressReader) Read(p []byte) (n int, err error) {
+	if err := pr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err = pr.r.Read(p)
+	pr.p.Add(n)
+	return
+}
+
+// progressReaderAt is like progressReader, for an io.ReaderAt. It also writes
+// everything read to w, which only makes sense if the reads are in order.
+type progressReaderAt struct {
+	ctx context.Context
+	p   Progress
+	r   io.ReaderAt
+	w   io.Writer
+}
+
+func (pr *progressReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
+	if err := pr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err = pr.r.ReadAt(p, off)
+	pr.p.Add(n)
+	pr.w.Write(p[:n])
+	return
+}
+
+type nopProgress struct{}
+
+func (nopProgress) Start(int, int64)       {}
+func (nopProgress) Add(int)                {}
+func (nopProgress) FileDone(string, error) {}
+func (nopProgress) Finish()                {}
+
+func (opts *GenOptions) newTree() *Tree {
+	t := &Tree{
+		CreatedAt: time.Now().UTC(),
+		Symlinks:  opts.Symlinks,
+
+		ExpandArchives: opts.ExpandArchives,
+		NoDigests:      opts.NoDigests,
+		Format:         FormatVersion,
+		Algorithm:      HashAlgorithm,
+		Gen:            opts.genInfo(),
+	}
+	if len(t.Symlinks) == 0 {
+		t.Symlinks = SymlinksSkip
+	}
+	if opts.Dirs {
+		t.Mode = ModeDirs
+	}
+	return t
+}
+
+// genInfo returns a copy of the generator details, to be stored in a tree.
+func (opts *GenOptions) genInfo() *GenInfo {
+	gen := &GenInfo{}
+	if opts.Generator != nil {
+		*gen = *opts.Generator
+	}
+	return gen
+}
+
+func (opts *GenOptions) newFileSet(t *Tree) *fileSet {
+	files := newFileSet(t)
+	if opts.Log != nil {
+		files.log = opts.Log
+	}
+	if len(opts.OnError) > 0 {
+		files.onError = opts.OnError
+	}
+	return files
+}
+
+// Generate creates a tree by hashing all the files in opts.Paths, or in
+// opts.Archive. If ctx is cancelled, all work stops and the context's error is
+// returned.
+func Generate(ctx context.Context, opts *GenOptions) (*Tree, error) {
+	t := opts.newTree()
+	switch t.Symlinks {
+	case SymlinksSkip, SymlinksFollow, SymlinksRecord:
+	default:
+		return nil, fmt.Errorf("invalid symlink policy: %s", t.Symlinks)
+	}
+	if err := opts.checkOnError(); err != nil {
+		return nil, err
+	}
+
+	if len(opts.Archive) > 0 {
+		if len(opts.Paths) > 0 {
+			return nil, errors.New("only one archive can be used, without any dir or file paths")
+		}
+		absPath, err := filepath.Abs(opts.Archive)
+		if err != nil {
+			return nil, err
+		}
+		t.Path = absPath
+		t.Archive = true
+		fsys, err := openArchive(os.DirFS(filepath.Dir(absPath)), filepath.Base(absPath))
+		if err != nil {
+			return nil, fmt.Errorf("error opening archive: %w", err)
+		}
+		defer fsys.Close()
+		if format := archiveFormat(fsys); len(opts.ArchiveFormat) > 0 && format != opts.ArchiveFormat {
+			return nil, fmt.Errorf("archive is a %s file, not %s", format, opts.ArchiveFormat)
+		}
+		t.Filter, err = NewFilter(fsys, opts.Include, opts.Exclude)
+		if err != nil {
+			return nil, err
+		}
+		files := opts.newFileSet(t)
+		files.rootFS[""] = fsys
+		files.custom = true
+		if err := generate(ctx, t, files, opts, nil); err != nil {
+			return nil, err
+		}
+		return t, nil
+	}
+
+	if len(opts.Paths) == 0 {
+		return nil, errors.New("at least one dir or file path is required")
+	}
+	roots, err := parseRoots(opts.Paths, opts.Include, opts.Exclude)
+	if err != nil {
+		return nil, err
+	}
+	t.Roots = roots
+	if fi, err := os.Stat(opts.Paths[0]); len(opts.Paths) == 1 && err == nil && fi.IsDir() {
+		// A single directory without a label doesn't need namespaced files
+		for _, r := range roots {
+			t.Path = r.Path
+			t.Filter = r.Filter
+			t.Roots = nil
+		}
+	}
+	if err := generate(ctx, t, opts.newFileSet(t), opts, nil); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// GenerateFS creates a tree of all the files in fsys instead of reading them
+// from disk. The filesystem could be an archive, a snapshot, or anything else.
+// Paths, Archive, and Symlinks in opts are ignored. Symlinks can't be followed
+// or read in an fs.FS, so they are always skipped, and the tree says so.
+func GenerateFS(ctx context.Context, fsys fs.FS, opts *GenOptions) (*Tree, error) {
+	if err := opts.checkOnError(); err != nil {
+		return nil, err
+	}
+	t := opts.newTree()
+	t.Symlinks = SymlinksSkip
+	var err error
+	t.Filter, err = NewFilter(fsys, opts.Include, opts.Exclude)
+	if err != nil {
+		return nil, err
+	}
+	files := opts.newFileSet(t)
+	files.rootFS[""] = fsys
+	files.custom = true
+	if err := generate(ctx, t, files, opts, nil); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// checkOnError returns an error if OnError isn't one of the policies.
+func (opts *GenOptions) checkOnError() error {
+	switch opts.OnError {
+	case "", OnErrorAbort, OnErrorSkip, OnErrorRecord:
+		return nil
+	}
+	return fmt.Errorf("invalid error policy: %s", opts.OnError)
+}
+
+// hashFile creates a leaf from the named file in the set. The unsalted
+// digest of the file contents is returned too, from the same read, unless
+// digests are turned off.
+func hashFile(ctx context.Context, files *fileSet, name string, progress Progress, opts *GenOptions) (*merkle.Node, []byte, error) {
+	f, err := files.open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	// This is a separate function so f is closed right away, rather than being
+	// left open while the worker loop runs. Otherwise the max open file limit
+	// will be hit for large dirs on at least some OSes like macOS.
+	defer f.Close()
+
+	var digest hash.Hash
+	var digestW io.Writer = io.Discard
+	if !opts.NoDigests {
+		digest = blake3.New(merkle.Blake3Size, nil)
+		digestW = digest
+	}
+	sum := func() []byte {
+		if digest == nil {
+			return nil
+		}
+		return digest.Sum(nil)
+	}
+
+	ra, isReaderAt := f.(io.ReaderAt)
+	sf, isFile := f.(fs.File)
+	if isReaderAt && isFile && opts.ParallelSize > 0 {
+		if fi, err := sf.Stat(); err == nil && fi.Size() >= opts.ParallelSize {
+			// HashLeafAt reads in order, so the digest can be calculated along the way
+			leaf, err := merkle.CreateLeafAt(name, &progressReaderAt{ctx, progress, ra, digestW}, fi.Size(), nil)
+			if err != nil {
+				return nil, nil, err
+			}
+			return leaf, sum(), nil
+		}
+	}
+	r := io.TeeReader(&progressReader{ctx, progress, f}, digestW)
+	var leaf *merkle.Node
+	if opts.BufferSize > 0 {
+		leaf, err = merkle.CreateLeafBuffer(name, r, nil, make([]byte, opts.BufferSize))
+	} else {
+		leaf, err = merkle.CreateLeaf(name, r, nil)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return leaf, sum(), nil
+}
+
+// deviceLimiter limits how many files are read from each device at once.
+type deviceLimiter struct {
+	limit int
+	mu    sync.Mutex
+	sems  map[uint64]chan struct{}
+}
+
+func newDeviceLimiter(limit int) *deviceLimiter {
+	return &deviceLimiter{limit: limit, sems: make(map[uint64]chan struct{})}
+}
+
+// acquire waits for a turn to read from the device, returning an error if ctx
+// is done first. The turn must be given back with release.
+func (dl *deviceLimiter) acquire(ctx context.Context, device uint64) error {
+	if dl.limit <= 0 {
+		return nil
+	}
+	dl.mu.Lock()
+	sem, ok := dl.sems[device]
+	if !ok {
+		sem = make(chan struct{}, dl.limit)
+		dl.sems[device] = sem
+	}
+	dl.mu.Unlock()
+	select {
+	case sem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (dl *deviceLimiter) release(device uint64) {
+	if dl.limit <= 0 {
+		return
+	}
+	dl.mu.Lock()
+	sem := dl.sems[device]
+	dl.mu.Unlock()
+	<-sem
+}
+
+// generate finds and hashes all the files for a tree, using the roots and
+// settings already in it, and fills in the rest of the tree. Leaves are reused
+// from the checkpoint for files that haven't changed, if it isn't nil.
+func generate(ctx context.Context, t *Tree, files *fileSet, opts *GenOptions, reuse *checkpoint) error {
+	progress := opts.Progress
+	if progress == nil {
+		progress = nopProgress{}
+	}
+
+	fmt.Fprintln(files.log, "Finding files...")
+	defer files.close()
+	if err := files.walk(ctx); err != nil {
+		return err
+	}
+	filePaths := files.filePaths
+	t.Gen.Ignored = files.ignored
+	t.Gen.SkippedLinks = files.skipped
+
+	// Leaves are kept in the order files were found, so runs over the same
+	// files always have the same layout.
+	leaves := make([]*merkle.Node, len(filePaths))
+	digests := make([][]byte, len(filePaths))
+	var cp *checkpoint
+	if len(opts.Checkpoint) > 0 {
+		cp = newCheckpoint(t)
+	}
+	if opts.Resume && cp != nil {
+		var err error
+		reuse, err = readCheckpoint(opts.Checkpoint, t)
+		if err != nil {
+			return err
+		}
+	}
+	var resumed int
+	var resumedSize int64
+	if reuse != nil {
+		for i, path := range filePaths {
+			stat := files.stats[path]
+			if leaf, digest := reuse.leaf(path, stat); leaf != nil {
+				leaves[i] = leaf
+				digests[i] = digest
+				resumed++
+				resumedSize += stat.size
+				if cp != nil {
+					cp.add(leaf, digest, stat)
+				}
+			}
+		}
+	}
+
+	fmt.Fprintf(files.log, "Found %d files. Starting hashing...\n", len(filePaths))
+	if resumed > 0 {
+		fmt.Fprintf(files.log, "Reusing %d unchanged files that were already hashed\n", resumed)
+	}
+	progress.Start(len(filePaths)-resumed, files.totalSize-resumedSize)
+
+	// Have a number of workers go through the files and hash them.
+	// The first error cancels the rest of the work, as does the caller.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var firstErr error
+	fail := func(err error) {
+		errOnce.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+	type result struct {
+		i      int
+		leaf   *merkle.Node // nil if the file couldn't be read
+		digest []byte
+		err    error // Why the file couldn't be read
+	}
+	resultCh := make(chan result)
+	indexCh := make(chan int)
+	devices := newDeviceLimiter(opts.DeviceJobs)
+	jobs := opts.Jobs
+	if jobs <= 0 {
+		// 2*numCPU workers is just a handpicked number.
+		// It seems to work better than just # of CPUs since this is more I/O-bound
+		// than CPU-bound since blake3 is so fast.
+		jobs = runtime.NumCPU() * 2
+	}
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := range indexCh {
+				path := filePaths[i]
+				device := files.stats[path].device
+				if err := devices.acquire(ctx, device); err != nil {
+					fail(err)
+					return
+				}
+				leaf, digest, err := hashFile(ctx, files, path, progress, opts)
+				devices.release(device)
+				if err != nil {
+					if ctx.Err() != nil {
+						// Cancelled, not a problem with the file
+						fail(ctx.Err())
+						return
+					}
+					if err := files.fileError(path, err); err != nil {
+						fail(err)
+						return
+					}
+				}
+				select {
+				case resultCh <- result{i, leaf, digest, err}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	// Assign work
+	go func() {
+		defer close(indexCh)
+		for i := range filePaths {
+			if leaves[i] != nil {
+				// Already hashed
+				continue
+			}
+			select {
+			case indexCh <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	// Signal when all workers have stopped
+	go func() {
+		wg.Wait()
+		close(resultCh)
+	}()
+
+	lastSave := time.Now()
+	for res := range resultCh {
+		leaves[res.i] = res.leaf
+		digests[res.i] = res.digest
+		progress.FileDone(filePaths[res.i], res.err)
+		if cp == nil || res.leaf == nil {
+			continue
+		}
+		cp.add(res.leaf, res.digest, files.stats[res.leaf.Name])
+		if time.Since(lastSave) > checkpointInterval {
+			if err := cp.write(opts.Checkpoint); err != nil {
+				fail(fmt.Errorf("error saving checkpoint: %w", err))
+			}
+			lastSave = time.Now()
+		}
+	}
+	if firstErr == nil {
+		// Cancelled before any worker noticed
+		firstErr = ctx.Err()
+	}
+	if firstErr != nil {
+		if cp != nil && len(cp.Leaves) > 0 {
+			// Keep what was done, so it can be resumed
+			if err := cp.write(opts.Checkpoint); err != nil {
+				return fmt.Errorf("%w (and error saving checkpoint: %v)", firstErr, err)
+			}
+		}
+		return firstErr
+	}
+	if cp != nil {
+		// Everything is hashed now, but writing the tree could still fail
+		if err := cp.write(opts.Checkpoint); err != nil {
+			return fmt.Errorf("error saving checkpoint: %w", err)
+		}
+	}
+
+	progress.Finish()
+
+	t.Meta = make(map[string]*FileMeta, len(leaves))
+	for i, leaf := range leaves {
+		if leaf == nil {
+			continue
+		}
+		stat := files.stats[leaf.Name]
+		t.Meta[leaf.Name] = &FileMeta{Digest: digests[i], Size: stat.size, ModTime: stat.modTime.UnixNano()}
+	}
+
+	if len(files.errs) > 0 {
+		names := make([]string, 0, len(files.errs))
+		for name := range files.errs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fmt.Fprintf(files.log, "%d files or directories could not be read and were left out:\n", len(names))
+		for _, name := range names {
+			fmt.Fprintf(files.log, "  %s: %s\n", name, files.errs[name])
+		}
+		if files.onError == OnErrorRecord {
+			t.Errors = files.errs
+		}
+		// Remove the gaps
+		hashed := leaves[:0]
+		for _, leaf := range leaves {
+			if leaf != nil {
+				hashed = append(hashed, leaf)
+			}
+		}
+		leaves = hashed
+	}
+
+	if t.Mode == ModeDirs {
+		t.Root, t.Files, t.Dirs = createDirTree(leaves, files.dirPaths)
+	} else {
+		t.Files = make(map[string]uint64, len(leaves))
+		for i, leaf := range leaves {
+			t.Files[leaf.Name] = uint64(i)
+		}
+		t.Root = merkle.CreateTree(leaves)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package tree
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"testing/fstest"
+
+	"github.com/makew0rld/merkdir/merkle"
+)
+
+// testFiles is the content of the filesystems used in tests, by path.
+var testFiles = map[string]string{
+	"a.txt":          "apple",
+	"b.txt":          "banana",
+	"sub/c.txt":      "cherry",
+	"sub/deep/d.txt": "date",
+	"sub/e.txt":      "apple",
+	"z/f.txt":        "fig",
+}
+
+// writeFiles writes files to a new temporary directory, and returns its path.
+func writeFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func mapFS(files map[string]string) fstest.MapFS {
+	fsys := make(fstest.MapFS, len(files))
+	for name, content := range files {
+		fsys[name] = &fstest.MapFile{Data: []byte(content), Mode: 0644}
+	}
+	return fsys
+}
+
+func TestGenerateFS(t *testing.T) {
+	dir := writeFiles(t, testFiles)
+	for _, dirs := range []bool{false, true} {
+		disk, err := Generate(context.Background(), &GenOptions{Paths: []string{dir}, Dirs: dirs})
+		if err != nil {
+			t.Fatal(err)
+		}
+		mem, err := GenerateFS(context.Background(), mapFS(testFiles), &GenOptions{Dirs: dirs})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(disk.Files) != len(testFiles) {
+			t.Fatalf("dirs=%v: tree has %d files, want %d", dirs, len(disk.Files), len(testFiles))
+		}
+		if !reflect.DeepEqual(mem.Files, disk.Files) {
+			t.Errorf("dirs=%v: files are %v, want %v", dirs, mem.Files, disk.Files)
+		}
+		if !reflect.DeepEqual(mem.Dirs, disk.Dirs) {
+			t.Errorf("dirs=%v: dirs are %v, want %v", dirs, mem.Dirs, disk.Dirs)
+		}
+		for name, meta := range disk.Meta {
+			if m := mem.Meta[name]; m == nil || !bytes.Equal(m.Digest, meta.Digest) || m.Size != meta.Size {
+				t.Errorf("dirs=%v: %s has different metadata", dirs, name)
+			}
+		}
+		if dirs {
+			continue
+		}
+
+		// Leaves have random nonces, so hash the files on disk with the nonces
+		// from the tree to get the same root.
+		leaves := make([]*merkle.Node, len(disk.Files))
+		for name, i := range disk.Files {
+			leaf, err := mem.Node(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f, err := os.Open(filepath.Join(dir, filepath.FromSlash(name)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			leaves[i], err = merkle.CreateLeaf(name, f, leaf.Nonce)
+			f.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if root := merkle.CreateTree(leaves); !bytes.Equal(root.Hash, mem.Root.Hash) {
+			t.Errorf("root is %x, want %x from the files on disk", mem.Root.Hash, root.Hash)
+		}
+	}
+}
+
+func TestGenerateFSOptions(t *testing.T) {
+	mem, err := GenerateFS(context.Background(), mapFS(testFiles), &GenOptions{Symlinks: SymlinksFollow})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mem.Symlinks != SymlinksSkip {
+		t.Errorf("symlink policy is %s, want %s", mem.Symlinks, SymlinksSkip)
+	}
+	if _, err := GenerateFS(context.Background(), mapFS(testFiles), &GenOptions{OnError: "ignore"}); err == nil {
+		t.Error("GenerateFS accepted an invalid error policy")
+	}
+}
+
+func TestSkippedSymlinks(t *testing.T) {
+	dir := writeFiles(t, testFiles)
+	if err := os.Symlink("a.txt", filepath.Join(dir, "link.txt")); err != nil {
+		t.Skip("can't make symlinks:", err)
+	}
+	if err := os.Symlink("sub", filepath.Join(dir, "dirlink")); err != nil {
+		t.Fatal(err)
+	}
+	tr, err := Generate(context.Background(), &GenOptions{Paths: []string{dir}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tr.Files) != len(testFiles) {
+		t.Errorf("tree has %d files, want %d", len(tr.Files), len(testFiles))
+	}
+	if tr.Gen.SkippedLinks != 2 || tr.Gen.Ignored != 0 {
+		t.Errorf("%d symlinks and %d special files left out, want 2 and 0", tr.Gen.SkippedLinks, tr.Gen.Ignored)
+	}
+}
@@ -0,0 +1,166 @@
+package tree
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// ignoreFile is read from the root of each directory given to gen, if it exists.
+const ignoreFile = ".merkdirignore"
+
+// Filter decides which files are part of a tree.
+// It is stored in the tree so that the directory can be checked later using the same rules.
+type Filter struct {
+	// Glob patterns, files must match one of these if any are set
+	Include []string `cbor:",omitempty"`
+	// gitignore-style patterns, from the ignore file and then any flags
+	Exclude []string `cbor:",omitempty"`
+
+	include []ignoreRule
+	exclude []ignoreRule
+}
+
+// ignoreRule is a single parsed gitignore-style pattern.
+type ignoreRule struct {
+	segments []string // Pattern split on slashes
+	negate   bool     // Pattern started with "!", it re-includes matching files
+	dirOnly  bool     // Pattern ended with a slash
+}
+
+// NewFilter creates a filter for the filesystem, using the given patterns and
+// its ignore file. It returns nil if there are no rules at all.
+func NewFilter(fsys fs.FS, include, exclude []string) (*Filter, error) {
+	ignored, err := readIgnoreFile(fsys)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", ignoreFile, err)
+	}
+	if len(ignored) == 0 && len(include) == 0 && len(exclude) == 0 {
+		return nil, nil
+	}
+	return &Filter{
+		Include: include,
+		Exclude: append(ignored, exclude...),
+	}, nil
+}
+
+// readIgnoreFile returns the patterns in the ignore file at the root of the filesystem.
+// It returns nothing if there is no ignore file.
+func readIgnoreFile(fsys fs.FS) ([]string, error) {
+	f, err := fsys.Open(ignoreFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, scanner.Err()
+}
+
+// parseIgnoreRule parses a line in gitignore syntax.
+// Patterns without a slash match at any depth, otherwise they are relative to the root.
+func parseIgnoreRule(pattern string) ignoreRule {
+	var r ignoreRule
+	if strings.HasPrefix(pattern, "!") {
+		r.negate = true
+		pattern = pattern[1:]
+	} else if strings.HasPrefix(pattern, `\`) {
+		// Escaped "#" or "!"
+		pattern = pattern[1:]
+	}
+	if strings.HasSuffix(pattern, "/") {
+		r.dirOnly = true
+		pattern = strings.TrimRight(pattern, "/")
+	}
+	if !strings.Contains(pattern, "/") {
+		pattern = "**/" + pattern
+	}
+	r.segments = strings.Split(strings.TrimPrefix(pattern, "/"), "/")
+	return r
+}
+
+func (r *ignoreRule) match(name string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	return matchSegments(r.segments, strings.Split(name, "/"))
+}
+
+// matchSegments matches path segments against pattern segments, where "**"
+// matches zero or more segments.
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern = pattern[1:]
+		name = name[1:]
+	}
+	return len(name) == 0
+}
+
+// parse prepares the rules for matching, it is called automatically.
+func (f *Filter) parse() {
+	if f.include != nil || f.exclude != nil {
+		return
+	}
+	f.include = make([]ignoreRule, len(f.Include))
+	for i, pattern := range f.Include {
+		f.include[i] = parseIgnoreRule(pattern)
+	}
+	f.exclude = make([]ignoreRule, len(f.Exclude))
+	for i, pattern := range f.Exclude {
+		f.exclude[i] = parseIgnoreRule(pattern)
+	}
+}
+
+// Skip reports whether the named file or directory should be left out of the tree.
+// The name is a slash-separated path relative to the root of the tree.
+func (f *Filter) Skip(name string, isDir bool) bool {
+	if f == nil || name == "." {
+		return false
+	}
+	f.parse()
+
+	// Like gitignore, the last matching pattern wins
+	excluded := false
+	for i := range f.exclude {
+		if f.exclude[i].match(name, isDir) {
+			excluded = !f.exclude[i].negate
+		}
+	}
+	if excluded || isDir || len(f.include) == 0 {
+		return excluded
+	}
+	for i := range f.include {
+		if f.include[i].match(name, false) {
+			return false
+		}
+	}
+	return true
+}
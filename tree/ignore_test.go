@@ -0,0 +1,178 @@
+package tree
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestMatchSegments(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{"a.txt", "a.txt", true},
+		{"a.txt", "b.txt", false},
+		{"*.txt", "a.txt", true},
+		{"*.txt", "sub/a.txt", false},
+		{"sub/*.txt", "sub/a.txt", true},
+		{"sub/*.txt", "sub/deep/a.txt", false},
+		{"**/a.txt", "a.txt", true},
+		{"**/a.txt", "sub/deep/a.txt", true},
+		{"sub/**/a.txt", "sub/a.txt", true},
+		{"sub/**/a.txt", "sub/x/y/a.txt", true},
+		{"sub/**/a.txt", "other/a.txt", false},
+		{"sub/**", "sub/x/y", true},
+		{"**", "anything/at/all", true},
+		{"sub", "sub/a.txt", false},
+	}
+	for _, tt := range tests {
+		got := matchSegments(strings.Split(tt.pattern, "/"), strings.Split(tt.name, "/"))
+		if got != tt.want {
+			t.Errorf("matchSegments(%q, %q) = %v, want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFilterSkip(t *testing.T) {
+	type check struct {
+		name  string
+		isDir bool
+		skip  bool
+	}
+	tests := []struct {
+		name    string
+		include []string
+		exclude []string
+		checks  []check
+	}{
+		{
+			name:    "unanchored",
+			exclude: []string{"*.log", "build"},
+			checks: []check{
+				{"a.log", false, true},
+				{"sub/deep/a.log", false, true},
+				{"a.txt", false, false},
+				{"build", true, true},
+				{"sub/build", true, true},
+			},
+		},
+		{
+			name:    "anchored",
+			exclude: []string{"/build", "docs/*.md"},
+			checks: []check{
+				{"build", true, true},
+				{"sub/build", true, false},
+				{"docs/a.md", false, true},
+				{"sub/docs/a.md", false, false},
+				{"docs/deep/a.md", false, false},
+			},
+		},
+		{
+			name:    "dir only",
+			exclude: []string{"tmp/"},
+			checks: []check{
+				{"tmp", true, true},
+				{"sub/tmp", true, true},
+				{"tmp", false, false},
+			},
+		},
+		{
+			name:    "double star",
+			exclude: []string{"sub/**/cache", "**/*.o"},
+			checks: []check{
+				{"sub/cache", true, true},
+				{"sub/x/y/cache", true, true},
+				{"cache", true, false},
+				{"a.o", false, true},
+				{"x/y/a.o", false, true},
+			},
+		},
+		{
+			name:    "negation",
+			exclude: []string{"*.log", "!keep.log"},
+			checks: []check{
+				{"a.log", false, true},
+				{"keep.log", false, false},
+				{"sub/keep.log", false, false},
+			},
+		},
+		{
+			name:    "last pattern wins",
+			exclude: []string{"!keep.log", "*.log"},
+			checks: []check{
+				{"keep.log", false, true},
+			},
+		},
+		{
+			name:    "escaped",
+			exclude: []string{`\!important`, `\#notes`},
+			checks: []check{
+				{"!important", false, true},
+				{"#notes", false, true},
+				{"important", false, false},
+			},
+		},
+		{
+			name:    "include",
+			include: []string{"*.go"},
+			checks: []check{
+				{"a.go", false, false},
+				{"sub/a.go", false, false},
+				{"a.txt", false, true},
+				// Directories are walked, so files in them can be included
+				{"sub", true, false},
+			},
+		},
+		{
+			name:    "include and exclude",
+			include: []string{"*.go"},
+			exclude: []string{"*_test.go", "vendor/"},
+			checks: []check{
+				{"a.go", false, false},
+				{"a_test.go", false, true},
+				{"vendor", true, true},
+				{"a.txt", false, true},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &Filter{Include: tt.include, Exclude: tt.exclude}
+			for _, c := range tt.checks {
+				if got := f.Skip(c.name, c.isDir); got != c.skip {
+					t.Errorf("Skip(%q, %v) = %v, want %v", c.name, c.isDir, got, c.skip)
+				}
+			}
+		})
+	}
+
+	var f *Filter
+	if f.Skip("a.txt", false) {
+		t.Error("nil filter skips files")
+	}
+}
+
+func TestNewFilter(t *testing.T) {
+	fsys := fstest.MapFS{
+		ignoreFile: &fstest.MapFile{Data: []byte("# comment\n\n*.log  \r\n!keep.log\n")},
+	}
+	f, err := NewFilter(fsys, nil, []string{"*.tmp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"*.log", "!keep.log", "*.tmp"}
+	if !reflect.DeepEqual(f.Exclude, want) {
+		t.Errorf("exclude patterns are %q, want %q", f.Exclude, want)
+	}
+
+	f, err = NewFilter(fstest.MapFS{}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f != nil {
+		t.Error("filter without any rules isn't nil")
+	}
+}
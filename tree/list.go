@@ -0,0 +1,92 @@
+package tree
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Orders for List
+const (
+	SortName  = "name"  // Sorted by name
+	SortIndex = "index" // Sorted by position in the tree, the order of the leaves
+)
+
+// Entry is a file in a tree, as returned by List.
+type Entry struct {
+	Name string
+	// Leaf number of the file. For hierarchical trees it is relative to the
+	// file's directory, like in Tree.Files.
+	Index uint64
+	Meta  *FileMeta // Nil for older trees
+}
+
+// ListOptions chooses which files List returns, and in what order.
+type ListOptions struct {
+	// Only list files matching this glob. It is matched against the whole name
+	// if it has a slash, and otherwise against the last element of the name,
+	// so "*.pdf" finds PDFs in any directory.
+	Glob   string
+	Regexp *regexp.Regexp // Only list files with names matching this
+	Sort   string         // SortName or SortIndex, empty is SortName
+}
+
+// List returns the files in the tree.
+func (t *Tree) List(opts *ListOptions) ([]*Entry, error) {
+	if len(opts.Glob) > 0 {
+		if _, err := path.Match(opts.Glob, ""); err != nil {
+			return nil, fmt.Errorf("invalid glob %q: %w", opts.Glob, err)
+		}
+	}
+	entries := make([]*Entry, 0, len(t.Files))
+	for name, index := range t.Files {
+		if len(opts.Glob) > 0 {
+			target := name
+			if !strings.Contains(opts.Glob, "/") {
+				target = path.Base(name)
+			}
+			if ok, _ := path.Match(opts.Glob, target); !ok {
+				continue
+			}
+		}
+		if opts.Regexp != nil && !opts.Regexp.MatchString(name) {
+			continue
+		}
+		entries = append(entries, &Entry{Name: name, Index: index, Meta: t.Meta[name]})
+	}
+
+	switch opts.Sort {
+	case "", SortName:
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	case SortIndex:
+		if t.Mode != ModeDirs {
+			sort.Slice(entries, func(i, j int) bool { return entries[i].Index < entries[j].Index })
+			break
+		}
+		// Leaves are ordered by the position of each directory above them
+		positions := make(map[string][]uint64, len(entries))
+		for _, e := range entries {
+			levels, err := t.levels(e.Name, ".")
+			if err != nil {
+				return nil, err
+			}
+			for _, l := range levels {
+				positions[e.Name] = append(positions[e.Name], l.index)
+			}
+		}
+		sort.Slice(entries, func(i, j int) bool {
+			a, b := positions[entries[i].Name], positions[entries[j].Name]
+			for k := 0; k < len(a) && k < len(b); k++ {
+				if a[k] != b[k] {
+					return a[k] < b[k]
+				}
+			}
+			return len(a) < len(b)
+		})
+	default:
+		return nil, fmt.Errorf("invalid sort order: %s", opts.Sort)
+	}
+	return entries, nil
+}
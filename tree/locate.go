@@ -0,0 +1,93 @@
+package tree
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/makew0rld/merkdir/merkle"
+	"lukechampine.com/blake3"
+)
+
+// Locate finds where the contents of the named file in t are in another tree,
+// such as a newer version of it. It returns the names of all the files in the
+// other tree with the same contents, sorted. It's not an error if there are
+// none.
+//
+// Both trees need content digests.
+func (t *Tree) Locate(name string, in *Tree) ([]string, error) {
+	meta, err := t.locateMeta(name)
+	if err != nil {
+		return nil, err
+	}
+	if !in.HasDigests() {
+		return nil, fmt.Errorf("the tree to search can't be used: %w", ErrNoDigests)
+	}
+	found := make([]string, 0)
+	for other := range in.Files {
+		if m, ok := in.Meta[other]; ok && bytes.Equal(m.Digest, meta.Digest) {
+			found = append(found, other)
+		}
+	}
+	sort.Strings(found)
+	return found, nil
+}
+
+// LocateInDir is like Locate, but searches the files in a directory on disk.
+// Only files with the same size as the named file are read. Symlinks are
+// skipped, and unreadable files are ignored.
+func (t *Tree) LocateInDir(ctx context.Context, name, dir string) ([]string, error) {
+	meta, err := t.locateMeta(name)
+	if err != nil {
+		return nil, err
+	}
+
+	walked := newFileSet(&Tree{Path: dir, Symlinks: SymlinksSkip})
+	defer walked.close()
+	walked.onError = OnErrorSkip
+	if err := walked.walk(ctx); err != nil {
+		return nil, err
+	}
+
+	found := make([]string, 0)
+	for _, other := range walked.filePaths {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if walked.stats[other].size != meta.Size {
+			continue
+		}
+		f, err := walked.open(other)
+		if err != nil {
+			continue
+		}
+		h := blake3.New(merkle.Blake3Size, nil)
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			continue
+		}
+		if bytes.Equal(h.Sum(nil), meta.Digest) {
+			found = append(found, other)
+		}
+	}
+	return found, nil
+}
+
+// locateMeta returns the metadata for a file to be located.
+func (t *Tree) locateMeta(name string) (*FileMeta, error) {
+	if !t.HasDigests() {
+		return nil, fmt.Errorf("file can't be located: %w", ErrNoDigests)
+	}
+	if _, ok := t.Files[name]; !ok {
+		return nil, errors.New("filename not found in tree")
+	}
+	meta, ok := t.Meta[name]
+	if !ok {
+		return nil, fmt.Errorf("file has no content digest: %s", name)
+	}
+	return meta, nil
+}
@@ -0,0 +1,104 @@
+package tree
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// RootInfo is one of the directories or files a tree was generated from.
+// Its files are stored in the tree under its label.
+type RootInfo struct {
+	Path    string  // Original absolute filesystem path
+	Filter  *Filter `cbor:",omitempty"` // Rules used to choose files, only for directories
+	Archive bool    `cbor:",omitempty"` // Path is a zip or tar file, and its members are the files
+}
+
+// ParseRootArg parses a path to generate a tree from, which can be given a
+// label like "label=path". Without a label the base name of the path is used.
+// The returned path is absolute.
+func ParseRootArg(arg string) (label, rootPath string, err error) {
+	rootPath = arg
+	if _, err := os.Stat(arg); err != nil && strings.Contains(arg, "=") {
+		label, rootPath, _ = strings.Cut(arg, "=")
+	}
+	if _, err := os.Stat(rootPath); err != nil {
+		return "", "", fmt.Errorf("not a valid path: %s", rootPath)
+	}
+	rootPath, err = filepath.Abs(rootPath)
+	if err != nil {
+		return "", "", err
+	}
+	if len(label) == 0 {
+		label = filepath.Base(rootPath)
+	}
+	if label == "." || label == ".." || strings.ContainsAny(label, `/\`) {
+		return "", "", fmt.Errorf("invalid label for %s, use label=path to set one", rootPath)
+	}
+	return label, rootPath, nil
+}
+
+// parseRoots creates roots from paths, see ParseRootArg.
+// Directories get a filter using the given patterns and their ignore file, if any.
+func parseRoots(args, include, exclude []string) (map[string]*RootInfo, error) {
+	roots := make(map[string]*RootInfo, len(args))
+	for _, arg := range args {
+		label, rootPath, err := ParseRootArg(arg)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := roots[label]; ok {
+			return nil, fmt.Errorf("duplicate label %s, use label=path to set a different one", label)
+		}
+		r := &RootInfo{Path: rootPath}
+		if fi, err := os.Stat(rootPath); err == nil && fi.IsDir() {
+			r.Filter, err = NewFilter(os.DirFS(rootPath), include, exclude)
+			if err != nil {
+				return nil, err
+			}
+		}
+		roots[label] = r
+	}
+	return roots, nil
+}
+
+// roots returns the roots of the tree sorted by label. Trees with a single
+// unlabeled directory return it with an empty label.
+func (t *Tree) roots() ([]string, map[string]*RootInfo) {
+	if len(t.Roots) == 0 {
+		return []string{""}, map[string]*RootInfo{"": {Path: t.Path, Filter: t.Filter, Archive: t.Archive}}
+	}
+	labels := make([]string, 0, len(t.Roots))
+	for label := range t.Roots {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	return labels, t.Roots
+}
+
+// joinLabel returns the name in the tree for a path relative to the root with the given label.
+func joinLabel(label, name string) string {
+	if len(label) == 0 {
+		return name
+	}
+	if name == "." {
+		return label
+	}
+	return label + "/" + name
+}
+
+// fsPath returns the path on disk for a file in the tree.
+func (t *Tree) fsPath(name string) (string, error) {
+	if len(t.Roots) == 0 {
+		return filepath.Join(t.Path, filepath.FromSlash(name)), nil
+	}
+	label, rest, _ := strings.Cut(name, "/")
+	r, ok := t.Roots[label]
+	if !ok {
+		return "", errors.New("file is not part of any root in the tree")
+	}
+	return filepath.Join(r.Path, filepath.FromSlash(rest)), nil
+}
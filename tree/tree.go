@@ -0,0 +1,424 @@
+// Package tree creates, stores, and queries Merkle trees of files.
+//
+// A Tree is usually made with Generate or GenerateFS, and saved with WriteFile.
+// Inclusion proofs for its files can then be made with Tree.InclusionProof and
+// checked with the merkle package.
+package tree
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/makew0rld/merkdir/merkle"
+)
+
+const (
+	ModeFlat = ""     // All files are leaves of a single tree
+	ModeDirs = "dirs" // Each directory is a subtree, whose root is a leaf of its parent
+)
+
+// FormatVersion is the version of the tree file format written by this package.
+// Trees from before the version was stored are version 1.
+const FormatVersion = 2
+
+// HashAlgorithm is the hash used for leaves, nodes, and content digests.
+const HashAlgorithm = "BLAKE3-256"
+
+// GenInfo describes how and where a tree was generated. None of it is part of
+// the Merkle tree. Everything but Ignored and SkippedLinks is up to the caller
+// of Generate, and is stored as is.
+type GenInfo struct {
+	Version string   `cbor:",omitempty"` // Version of the program that generated the tree
+	Host    string   `cbor:",omitempty"`
+	User    string   `cbor:",omitempty"`
+	Args    []string `cbor:",omitempty"` // Command line arguments it was run with
+	// Number of special files, like sockets and devices, that were left out
+	Ignored int `cbor:",omitempty"`
+	// Number of symlinks that were left out, see SymlinksSkip
+	SkippedLinks int `cbor:",omitempty"`
+}
+
+// Tree holds extra Merkle tree information used for serialization.
+type Tree struct {
+	Path string // Original absolute filesystem path, for trees of a single unlabeled directory
+	// Path is a zip or tar file, and its members are the files of the tree
+	Archive bool `cbor:",omitempty"`
+	// Map relative filepaths to leaf numbers. Also len(files) = tree size.
+	// For hierarchical trees the leaf number is relative to the file's directory.
+	Files     map[string]uint64
+	CreatedAt time.Time
+	Root      *merkle.Node
+	Filter    *Filter `cbor:",omitempty"` // Rules used to choose files, if any
+	Symlinks  string  `cbor:",omitempty"` // Symlink policy, empty for older trees that skipped them
+	// Map labels to the directories or files the tree was generated from, if
+	// there are multiple. Files are named with the label as the first path element.
+	Roots map[string]*RootInfo `cbor:",omitempty"`
+	// Files and directories that couldn't be read and were left out, mapped to the error
+	Errors map[string]string `cbor:",omitempty"`
+	// Archives were treated as directories, with members named like "bundle.zip!/file.txt"
+	ExpandArchives bool `cbor:",omitempty"`
+
+	Mode string              `cbor:",omitempty"`
+	Dirs map[string]*DirInfo `cbor:",omitempty"` // Only for hierarchical trees, "." is the root
+
+	// Details about each file that aren't part of the Merkle tree, and so are
+	// never in proofs. Older trees don't have this.
+	Meta      map[string]*FileMeta `cbor:",omitempty"`
+	NoDigests bool                 `cbor:",omitempty"` // Meta has no content digests
+
+	Format    int      `cbor:",omitempty"` // See FormatVersion, older trees don't have this
+	Algorithm string   `cbor:",omitempty"` // See HashAlgorithm, older trees don't have this
+	Gen       *GenInfo `cbor:",omitempty"` // Older trees don't have this
+
+	// Set for trees created by extract, which only hold the files in one directory
+	Prefix string `cbor:",omitempty"`
+	Size   uint64 `cbor:",omitempty"` // Number of leaves, as Files doesn't have all of them
+}
+
+// FileMeta holds details about a file when the tree was generated.
+type FileMeta struct {
+	// Unsalted BLAKE3-256 hash of the file contents, the same as b3sum. Unlike
+	// leaf hashes this can be compared between trees, to see if files changed.
+	// Anyone with the tree file can use it to check if a file they have is in
+	// the tree, so it can be turned off with GenOptions.NoDigests.
+	Digest  []byte
+	Size    int64
+	ModTime int64 // Unix nanoseconds, as CBOR times only keep seconds
+}
+
+// ErrNoDigests is returned when a tree doesn't have the content digests
+// needed to compare files, see HasDigests. Trees can be generated without
+// them, and older versions of merkdir didn't make them.
+var ErrNoDigests = errors.New("tree has no content digests")
+
+// HasDigests reports whether the tree has content digests for its files.
+func (t *Tree) HasDigests() bool {
+	return t.Meta != nil && !t.NoDigests
+}
+
+// DirInfo describes a directory in a hierarchical tree.
+type DirInfo struct {
+	Index uint64 // Leaf number of this directory within its parent directory
+	Size  uint64 // Number of files and directories directly inside this one
+}
+
+// level is the position of a leaf within one of the trees of a hierarchical tree.
+// Flat trees only have one level.
+type level struct {
+	size  uint64
+	index uint64
+}
+
+// size returns the number of leaves in a flat tree.
+func (t *Tree) size() uint64 {
+	if t.Size > 0 {
+		return t.Size
+	}
+	return uint64(len(t.Files))
+}
+
+// inDir reports whether the named file or directory is dir or inside of it.
+func inDir(name, dir string) bool {
+	return dir == "." || name == dir || strings.HasPrefix(name, dir+"/")
+}
+
+// createDirTree creates a hierarchical Merkle tree from the given leaves, which
+// are named by their file paths. All directories must be provided, so that empty
+// ones can be included.
+//
+// Entries are ordered by name within each directory, like fs.WalkDir.
+func createDirTree(leaves []*merkle.Node, dirPaths []string) (*merkle.Node, map[string]uint64, map[string]*DirInfo) {
+	leafMap := make(map[string]*merkle.Node, len(leaves))
+	children := make(map[string][]string)
+	for _, leaf := range leaves {
+		leafMap[leaf.Name] = leaf
+		dir := path.Dir(leaf.Name)
+		children[dir] = append(children[dir], leaf.Name)
+	}
+	dirs := make(map[string]*DirInfo, len(dirPaths))
+	for _, dirPath := range dirPaths {
+		dirs[dirPath] = &DirInfo{}
+		if dirPath != "." {
+			parent := path.Dir(dirPath)
+			children[parent] = append(children[parent], dirPath)
+		}
+	}
+	dirs["."] = &DirInfo{}
+
+	files := make(map[string]uint64, len(leaves))
+	var build func(dir string) *merkle.Node
+	build = func(dir string) *merkle.Node {
+		names := children[dir]
+		sort.Strings(names)
+		nodes := make([]*merkle.Node, len(names))
+		for i, name := range names {
+			if _, ok := dirs[name]; ok {
+				dirs[name].Index = uint64(i)
+				nodes[i] = merkle.CreateDirLeaf(name, build(name))
+			} else {
+				files[name] = uint64(i)
+				nodes[i] = leafMap[name]
+			}
+		}
+		dirs[dir].Size = uint64(len(names))
+		return merkle.CreateTree(nodes)
+	}
+	return build("."), files, dirs
+}
+
+// levels returns the leaf positions needed to reach the named file or directory,
+// starting from the base directory. They are ordered from outermost to innermost.
+func (t *Tree) levels(name, base string) ([]level, error) {
+	if t.Mode != ModeDirs {
+		if base != "." {
+			return nil, errors.New("only hierarchical trees have directories")
+		}
+		leafN, ok := t.Files[name]
+		if !ok {
+			return nil, errors.New("filename not found in tree")
+		}
+		return []level{{size: t.size(), index: leafN}}, nil
+	}
+
+	if _, ok := t.Dirs[base]; !ok {
+		return nil, errors.New("directory not found in tree")
+	}
+	var levels []level
+	for cur := name; cur != base; cur = path.Dir(cur) {
+		if cur == "." {
+			return nil, fmt.Errorf("%s is not inside of %s", name, base)
+		}
+		var index uint64
+		if d, ok := t.Dirs[cur]; ok {
+			index = d.Index
+		} else if leafN, ok := t.Files[cur]; ok {
+			index = leafN
+		} else {
+			return nil, errors.New("filename not found in tree")
+		}
+		levels = append(levels, level{size: t.Dirs[path.Dir(cur)].Size, index: index})
+	}
+	// Reverse into top-to-bottom order
+	for i, j := 0, len(levels)-1; i < j; i, j = i+1, j-1 {
+		levels[i], levels[j] = levels[j], levels[i]
+	}
+	return levels, nil
+}
+
+// Node returns the node for the named file, or directory in a hierarchical tree.
+func (t *Tree) Node(name string) (*merkle.Node, error) {
+	if name == "." {
+		return t.Root, nil
+	}
+	levels, err := t.levels(name, ".")
+	if err != nil {
+		return nil, err
+	}
+	node := t.Root
+	for _, l := range levels {
+		node, err = merkle.GetLeaf(node, l.size, l.index)
+		if err != nil {
+			return nil, err
+		}
+		if node.Dir != nil {
+			// Directories are found by the root of their own tree
+			node = node.Dir
+		}
+	}
+	return node, nil
+}
+
+// LeafNames returns the names of the leaves of a tree, indexed by leaf number.
+// It is the reverse of Files, and can be reused for looking up many leaves.
+// For hierarchical trees the leaves are the files and directories directly
+// inside dir, otherwise dir must be ".".
+//
+// Leaves left out of an extracted tree have an empty name.
+func (t *Tree) LeafNames(dir string) ([]string, error) {
+	var size uint64
+	if t.Mode != ModeDirs {
+		if dir != "." {
+			return nil, errors.New("only hierarchical trees have directories")
+		}
+		size = t.size()
+	} else {
+		d, ok := t.Dirs[dir]
+		if !ok {
+			return nil, errors.New("directory not found in tree")
+		}
+		size = d.Size
+	}
+
+	names := make([]string, size)
+	add := func(name string, index uint64) {
+		if t.Mode == ModeDirs && path.Dir(name) != dir {
+			return
+		}
+		if index < size {
+			names[index] = name
+		}
+	}
+	for name, index := range t.Files {
+		add(name, index)
+	}
+	for name, d := range t.Dirs {
+		if name != "." {
+			add(name, d.Index)
+		}
+	}
+	return names, nil
+}
+
+// InclusionProof returns a proof for the named file, or directory in a
+// hierarchical tree, relative to the root of the base directory. Use "." for
+// the root of the whole tree.
+func (t *Tree) InclusionProof(name, base string) (*merkle.InclusionProof, error) {
+	levels, err := t.levels(name, base)
+	if err != nil {
+		return nil, err
+	}
+	if len(levels) == 0 {
+		return nil, errors.New("cannot prove a directory is part of itself")
+	}
+	node, err := t.Node(base)
+	if err != nil {
+		return nil, fmt.Errorf("error finding directory in tree: %w", err)
+	}
+
+	// Each level is proved against the root of the level above it
+	proofs := make([]*merkle.InclusionProof, len(levels))
+	for i, l := range levels {
+		proofs[i], err = merkle.GetInclusionProof(node, l.size, l.index)
+		if err != nil {
+			return nil, fmt.Errorf("error calculating proof: %w", err)
+		}
+		proofs[i].Nonce = nil
+		node, err = merkle.GetLeaf(node, l.size, l.index)
+		if err != nil {
+			return nil, fmt.Errorf("error calculating proof: %w", err)
+		}
+		if node.Dir != nil {
+			node = node.Dir
+		}
+	}
+
+	ip := proofs[len(proofs)-1]
+	if _, isDir := t.Dirs[name]; !isDir {
+		// Files need a nonce, directories have none
+		ip.Nonce = node.Nonce
+	}
+	for i := len(proofs) - 2; i >= 0; i-- {
+		ip.Parents = append(ip.Parents, proofs[i])
+	}
+	return ip, nil
+}
+
+// Extract returns a copy of the tree that only has the files inside dir.
+//
+// Everything else is pruned from the tree, so the root hash stays the same as the
+// original. This makes the extracted tree a proof that its files are part of the
+// original tree, while not revealing anything about the other files.
+//
+// The names, metadata, and errors of the files inside dir are kept, along with
+// the settings that decide how files are hashed. The paths on disk, filter
+// patterns, and details of who generated the tree are left out, since they can
+// reveal things about the other files. So the extracted tree finds files
+// relative to the current directory, or to the directory given to VerifyDir.
+func (t *Tree) Extract(dir string) (*Tree, error) {
+	ext := &Tree{
+		Files:     make(map[string]uint64),
+		CreatedAt: t.CreatedAt,
+		Symlinks:  t.Symlinks,
+		Mode:      t.Mode,
+
+		ExpandArchives: t.ExpandArchives,
+		NoDigests:      t.NoDigests,
+		Format:         t.Format,
+		Algorithm:      t.Algorithm,
+		Prefix:         dir,
+	}
+	if t.Gen != nil {
+		ext.Gen = &GenInfo{Version: t.Gen.Version}
+	}
+	for name, leafN := range t.Files {
+		if inDir(name, dir) {
+			ext.Files[name] = leafN
+		}
+	}
+	for name, meta := range t.Meta {
+		if inDir(name, dir) {
+			if ext.Meta == nil {
+				ext.Meta = make(map[string]*FileMeta)
+			}
+			ext.Meta[name] = meta
+		}
+	}
+	for name, msg := range t.Errors {
+		if inDir(name, dir) {
+			if ext.Errors == nil {
+				ext.Errors = make(map[string]string)
+			}
+			ext.Errors[name] = msg
+		}
+	}
+
+	if t.Mode != ModeDirs {
+		if len(ext.Files) == 0 {
+			return nil, errors.New("no files found in that directory")
+		}
+		ext.Size = t.size()
+		ext.Root = merkle.PruneTree(t.Root, ext.Size, func(m uint64, leaf *merkle.Node) *merkle.Node {
+			if _, ok := ext.Files[leaf.Name]; ok {
+				return leaf
+			}
+			return nil
+		})
+		return ext, nil
+	}
+
+	if _, ok := t.Dirs[dir]; !ok {
+		return nil, errors.New("directory not found in tree")
+	}
+	// Keep the directory, everything in it, and the directories leading to it
+	ext.Dirs = make(map[string]*DirInfo)
+	children := make(map[string]map[uint64]string)
+	for name, d := range t.Dirs {
+		if inDir(name, dir) || inDir(dir, name) {
+			ext.Dirs[name] = d
+		}
+		if name != "." {
+			parent := path.Dir(name)
+			if children[parent] == nil {
+				children[parent] = make(map[uint64]string)
+			}
+			children[parent][d.Index] = name
+		}
+	}
+
+	var pruneDir func(name string, node *merkle.Node) *merkle.Node
+	pruneDir = func(name string, node *merkle.Node) *merkle.Node {
+		return merkle.PruneTree(node, t.Dirs[name].Size, func(m uint64, leaf *merkle.Node) *merkle.Node {
+			child, ok := children[name][m]
+			if !ok {
+				// Files outside of dir were already dropped
+				if _, ok := ext.Files[leaf.Name]; ok {
+					return leaf
+				}
+				return nil
+			}
+			if inDir(child, dir) {
+				return leaf
+			}
+			if inDir(dir, child) {
+				return &merkle.Node{Name: leaf.Name, Hash: leaf.Hash, Dir: pruneDir(child, leaf.Dir)}
+			}
+			return nil
+		})
+	}
+	ext.Root = pruneDir(".", t.Root)
+	return ext, nil
+}
@@ -0,0 +1,62 @@
+package tree
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestExtract(t *testing.T) {
+	files := make(map[string]string)
+	for name, content := range testFiles {
+		files["docs/"+name] = content
+		files["more/"+name] = content
+	}
+	base := writeFiles(t, files)
+	for _, dirs := range []bool{false, true} {
+		tr, err := Generate(context.Background(), &GenOptions{
+			Paths:     []string{"docs=" + filepath.Join(base, "docs"), "more=" + filepath.Join(base, "more")},
+			Dirs:      dirs,
+			Exclude:   []string{"*.secret"},
+			Generator: &GenInfo{Version: "v1", Host: "host", User: "user"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ext, err := tr.Extract("docs/sub")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(ext.Root.Hash, tr.Root.Hash) {
+			t.Errorf("dirs=%v: root hash changed", dirs)
+		}
+		if len(ext.Path) > 0 || ext.Filter != nil || len(ext.Roots) > 0 {
+			t.Errorf("dirs=%v: paths or patterns were kept", dirs)
+		}
+		if !reflect.DeepEqual(ext.Gen, &GenInfo{Version: "v1"}) {
+			t.Errorf("dirs=%v: generator details are %+v", dirs, ext.Gen)
+		}
+		if len(ext.Files) != 3 || len(ext.Meta) != 3 {
+			t.Errorf("dirs=%v: %d files and %d metadata kept, want 3", dirs, len(ext.Files), len(ext.Meta))
+		}
+		for name := range ext.Files {
+			if ok, err := ext.VerifyFile(name); err == nil || ok {
+				// Relative to the current directory, which doesn't have the files
+				t.Errorf("dirs=%v: %s was found without the original path", dirs, name)
+			}
+		}
+		if _, err := ext.VerifyDir(""); err == nil {
+			t.Errorf("dirs=%v: VerifyDir worked without a directory", dirs)
+		}
+		// Names start with the label, so this holds a docs directory
+		report, err := ext.VerifyDir(base)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !report.OK() {
+			t.Errorf("dirs=%v: extracted files don't match: %+v", dirs, report)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package tree
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Update creates a new version of a tree, using the same paths and settings it
+// was generated with. Files whose size and modification time haven't changed
+// aren't read again, and keep their leaves. Everything else is hashed like
+// Generate.
+//
+// Only the progress, logging, and performance options in opts are used. Use
+// Compare to find out what changed.
+func Update(ctx context.Context, old *Tree, opts *GenOptions) (*Tree, error) {
+	if len(old.Prefix) > 0 {
+		return nil, errors.New("extracted trees can't be updated, update the original instead")
+	}
+	if len(old.Roots) == 0 && len(old.Path) == 0 {
+		return nil, errors.New("tree wasn't generated from files on disk")
+	}
+	t := &Tree{
+		Path:           old.Path,
+		Archive:        old.Archive,
+		CreatedAt:      time.Now().UTC(),
+		Filter:         old.Filter,
+		Symlinks:       old.Symlinks,
+		Roots:          old.Roots,
+		ExpandArchives: old.ExpandArchives,
+		Mode:           old.Mode,
+		NoDigests:      old.NoDigests,
+		Format:         FormatVersion,
+		Algorithm:      HashAlgorithm,
+		Gen:            opts.genInfo(),
+	}
+	if len(t.Symlinks) == 0 {
+		t.Symlinks = SymlinksSkip
+	}
+	updateOpts := *opts
+	updateOpts.NoDigests = old.NoDigests
+
+	reuse := newCheckpoint(old)
+	for name := range old.Files {
+		meta, ok := old.Meta[name]
+		if !ok {
+			// Older trees don't have what's needed to tell if files changed
+			continue
+		}
+		leaf, err := old.Node(name)
+		if err != nil {
+			return nil, err
+		}
+		reuse.Leaves[name] = &checkpointLeaf{
+			Size:    meta.Size,
+			ModTime: meta.ModTime,
+			Nonce:   leaf.Nonce,
+			Hash:    leaf.Hash,
+			Digest:  meta.Digest,
+		}
+	}
+
+	if err := generate(ctx, t, updateOpts.newFileSet(t), &updateOpts, reuse); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
@@ -0,0 +1,97 @@
+package tree
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/makew0rld/merkdir/merkle"
+)
+
+func TestUpdate(t *testing.T) {
+	for _, dirs := range []bool{false, true} {
+		dir := writeFiles(t, testFiles)
+		old, err := Generate(context.Background(), &GenOptions{Paths: []string{dir}, Dirs: dirs})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		changed := filepath.Join(dir, "sub", "c.txt")
+		if err := os.WriteFile(changed, []byte("CHERRY"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		later := time.Now().Add(time.Hour)
+		if err := os.Chtimes(changed, later, later); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "sub", "new.txt"), []byte("new"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Remove(filepath.Join(dir, "z", "f.txt")); err != nil {
+			t.Fatal(err)
+		}
+
+		updated, err := Update(context.Background(), old, &GenOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if updated.Mode != old.Mode || updated.Path != old.Path {
+			t.Errorf("dirs=%v: settings weren't kept", dirs)
+		}
+		for name := range old.Files {
+			if name == "z/f.txt" {
+				continue
+			}
+			oldLeaf, err := old.Node(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			leaf, err := updated.Node(name)
+			if err != nil {
+				t.Fatalf("dirs=%v: %v", dirs, err)
+			}
+			reused := bytes.Equal(leaf.Nonce, oldLeaf.Nonce) && bytes.Equal(leaf.Hash, oldLeaf.Hash)
+			if name != "sub/c.txt" {
+				if !reused {
+					t.Errorf("dirs=%v: unchanged %s was hashed again", dirs, name)
+				}
+				continue
+			}
+			if reused {
+				t.Errorf("dirs=%v: changed %s was reused", dirs, name)
+			}
+			want, err := merkle.HashLeaf(bytes.NewReader([]byte("CHERRY")), leaf.Nonce)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(leaf.Hash, want) {
+				t.Errorf("dirs=%v: changed %s has the wrong hash", dirs, name)
+			}
+		}
+
+		diff, err := Compare(old, updated)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := &Diff{
+			Added:    []string{"sub/new.txt"},
+			Removed:  []string{"z/f.txt"},
+			Modified: []string{"sub/c.txt"},
+			Moved:    []Move{},
+		}
+		if !reflect.DeepEqual(diff, want) {
+			t.Errorf("dirs=%v: diff is %+v, want %+v", dirs, diff, want)
+		}
+		if report, err := updated.VerifyDir(""); err != nil || !report.OK() {
+			t.Errorf("dirs=%v: updated tree doesn't match the directory: %+v, %v", dirs, report, err)
+		}
+	}
+
+	if _, err := Update(context.Background(), &Tree{Path: "/x", Prefix: "sub"}, &GenOptions{}); err == nil {
+		t.Error("extracted tree was updated")
+	}
+}
@@ -0,0 +1,150 @@
+package tree
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/makew0rld/merkdir/merkle"
+)
+
+// VerifyFile reports whether the named file on disk still matches its leaf in
+// the tree.
+//
+// This assumes the tree is valid. So it only checks that the file hash matches
+// the one stored in the tree (plus nonce etc.), not that the hash can be traced
+// back to the root.
+func (t *Tree) VerifyFile(name string) (bool, error) {
+	if _, ok := t.Files[name]; !ok {
+		return false, errors.New("file with that name not found in Merkle tree")
+	}
+	leaf, err := t.Node(name)
+	if err != nil {
+		return false, fmt.Errorf("error finding leaf in tree: %w", err)
+	}
+	files := newFileSet(t)
+	defer files.close()
+	return checkFile(files, leaf, name)
+}
+
+// checkFile reports whether the named file on disk still matches the given leaf.
+func checkFile(files *fileSet, leaf *merkle.Node, name string) (bool, error) {
+	f, err := files.open(name)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	hash, err := merkle.HashLeaf(f, leaf.Nonce)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(hash, leaf.Hash), nil
+}
+
+// DirReport lists the differences between a tree and the files on disk.
+// All names are sorted.
+type DirReport struct {
+	Changed []string // Files whose contents no longer match the tree
+	New     []string // Files that aren't in the tree
+	Missing []string // Files in the tree that weren't found
+}
+
+// OK reports whether the files on disk still match the tree exactly.
+func (r *DirReport) OK() bool {
+	return len(r.Changed)+len(r.New)+len(r.Missing) == 0
+}
+
+// VerifyDir finds and hashes files using the same rules as when the tree was
+// generated, and reports how they differ from it. If dir isn't empty it is used
+// instead of the directory stored in the tree, which is only possible for trees
+// of a single directory.
+//
+// Like VerifyFile, this assumes the tree is valid.
+func (t *Tree) VerifyDir(dir string) (*DirReport, error) {
+	if len(dir) > 0 {
+		if len(t.Roots) > 0 {
+			return nil, errors.New("tree has multiple roots, so the directory path can't be changed")
+		}
+		moved := *t
+		moved.Path = dir
+		t = &moved
+	} else if len(t.Roots) == 0 && len(t.Path) == 0 {
+		return nil, errors.New("tree doesn't store a directory path, so one must be given")
+	}
+
+	walked := newFileSet(t)
+	defer walked.close()
+	// Files that were already unreadable when the tree was generated are fine
+	walked.onError = OnErrorSkip
+	if err := walked.walk(context.Background()); err != nil {
+		return nil, err
+	}
+	var errNames []string
+	for name := range walked.errs {
+		if !t.knownError(name) {
+			errNames = append(errNames, name)
+		}
+	}
+	if len(errNames) > 0 {
+		sort.Strings(errNames)
+		errs := make([]error, len(errNames))
+		for i, name := range errNames {
+			errs[i] = errors.New(walked.errs[name])
+		}
+		return nil, errors.Join(errs...)
+	}
+	prefix := "."
+	if len(t.Prefix) > 0 {
+		prefix = t.Prefix
+	}
+
+	report := &DirReport{}
+	found := make(map[string]bool, len(walked.filePaths))
+	for _, name := range walked.filePaths {
+		if !inDir(name, prefix) {
+			continue
+		}
+		found[name] = true
+		if _, ok := t.Files[name]; !ok {
+			if t.knownError(name) {
+				// Left out of the tree on purpose
+				continue
+			}
+			report.New = append(report.New, name)
+			continue
+		}
+		leaf, err := t.Node(name)
+		if err != nil {
+			return nil, fmt.Errorf("error finding leaf in tree: %w", err)
+		}
+		ok, err := checkFile(walked, leaf, name)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			report.Changed = append(report.Changed, name)
+		}
+	}
+	for name := range t.Files {
+		if !found[name] {
+			report.Missing = append(report.Missing, name)
+		}
+	}
+	sort.Strings(report.Changed)
+	sort.Strings(report.New)
+	sort.Strings(report.Missing)
+	return report, nil
+}
+
+// knownError reports whether the named file or directory couldn't be read when
+// the tree was generated, or is inside a directory that couldn't be.
+func (t *Tree) knownError(name string) bool {
+	for errName := range t.Errors {
+		if inDir(name, errName) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,57 @@
+package tree
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestVerifyDir(t *testing.T) {
+	dir := writeFiles(t, testFiles)
+	tr, err := Generate(context.Background(), &GenOptions{Paths: []string{dir}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := tr.VerifyDir("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Fatalf("unchanged directory isn't OK: %+v", report)
+	}
+
+	// Like a directory that couldn't be read when the tree was generated. The
+	// leaves are left in place, so the size has to be kept too.
+	tr.Size = uint64(len(tr.Files))
+	delete(tr.Files, "sub/c.txt")
+	delete(tr.Files, "sub/deep/d.txt")
+	delete(tr.Files, "sub/e.txt")
+	tr.Errors = map[string]string{"sub": "permission denied"}
+	report, err = tr.VerifyDir("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Errorf("files in an unreadable directory are reported: %+v", report)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("apricot"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "new.txt"), []byte("nectarine"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "z", "f.txt")); err != nil {
+		t.Fatal(err)
+	}
+	report, err = tr.VerifyDir("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &DirReport{Changed: []string{"a.txt"}, New: []string{"new.txt"}, Missing: []string{"z/f.txt"}}
+	if !reflect.DeepEqual(report, want) {
+		t.Errorf("report is %+v, want %+v", report, want)
+	}
+}
@@ -0,0 +1,446 @@
+package tree
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Symlink policies for gen
+const (
+	SymlinksSkip   = "skip"   // Leave symlinks out of the tree
+	SymlinksFollow = "follow" // Include the files and directories symlinks point to
+	SymlinksRecord = "record" // Include symlinks as leaves, hashing the link target path
+)
+
+// Policies for files that can't be read while generating a tree
+const (
+	OnErrorAbort  = "abort"  // Stop generating the tree
+	OnErrorSkip   = "skip"   // Leave the file out of the tree
+	OnErrorRecord = "record" // Leave the file out, and list it in the tree's Errors
+)
+
+// fileSet holds the files and directories found for a tree, and opens them for
+// hashing. Paths are names in the tree, see fsPath.
+type fileSet struct {
+	t         *Tree
+	filePaths []string
+	dirPaths  []string
+	totalSize int64
+	stats     map[string]fileStat // Size and modification time of each file, by path
+
+	mu sync.Mutex
+	// Filesystems for roots, by label. These can be set before walking to read
+	// from somewhere other than the paths on disk stored in the tree.
+	rootFS   map[string]fs.FS
+	custom   bool                 // Whether rootFS was set, instead of using the disk
+	archives map[string]archiveFS // Opened archives, by name in the tree
+	log      io.Writer            // Where to report ignored files
+
+	onError string            // Policy for unreadable files and directories
+	errs    map[string]string // Errors for the files and directories that were left out, by path
+	ignored int               // Number of special files left out
+	skipped int               // Number of symlinks left out
+}
+
+func newFileSet(t *Tree) *fileSet {
+	return &fileSet{
+		t:         t,
+		filePaths: make([]string, 0),
+		dirPaths:  make([]string, 0),
+		stats:     make(map[string]fileStat),
+		rootFS:    make(map[string]fs.FS),
+		archives:  make(map[string]archiveFS),
+		log:       io.Discard,
+		onError:   OnErrorAbort,
+		errs:      make(map[string]string),
+	}
+}
+
+// fileStat is what's needed to tell if a file has changed without reading it.
+// The device is used to limit how many files are read from each disk at once.
+type fileStat struct {
+	size    int64
+	modTime time.Time
+	device  uint64
+}
+
+// addFile adds a file to be hashed. The size is passed separately since it
+// isn't always the size of the file info, like for recorded symlinks.
+func (res *fileSet) addFile(name string, size int64, fi fs.FileInfo) {
+	res.totalSize += size
+	res.filePaths = append(res.filePaths, name)
+	res.stats[name] = fileStat{size: size, modTime: fi.ModTime(), device: deviceID(fi)}
+}
+
+// fileError handles an error reading the named file or directory. It returns
+// the error if the policy is to abort, or records it and returns nil.
+func (res *fileSet) fileError(name string, err error) error {
+	if res.onError == OnErrorAbort || len(res.onError) == 0 {
+		return err
+	}
+	res.mu.Lock()
+	defer res.mu.Unlock()
+	res.errs[name] = err.Error()
+	return nil
+}
+
+// walk finds all the files and directories to include in the tree, using the
+// roots and rules stored in it, stopping early if ctx is done. The set must be
+// closed after use.
+func (res *fileSet) walk(ctx context.Context) error {
+	labels, roots := res.t.roots()
+	for _, label := range labels {
+		r := roots[label]
+		if !res.custom && !r.Archive {
+			fi, err := os.Stat(r.Path)
+			if err != nil {
+				return err
+			}
+			if !fi.IsDir() {
+				if res.t.ExpandArchives && isArchive(r.Path) {
+					if err := res.walkArchive(ctx, label, nil); err != nil {
+						return err
+					}
+					continue
+				}
+				res.addFile(label, fi.Size(), fi)
+				continue
+			}
+		}
+		fsys, err := res.root(label)
+		if err != nil {
+			return err
+		}
+		osPath := r.Path
+		if res.custom || r.Archive {
+			// Not on disk, so symlinks can't be handled
+			osPath = ""
+		}
+		if err := res.walkFS(ctx, fsys, osPath, label, r.Filter); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkFS finds all the regular files and directories to include from one root
+// filesystem, and adds them under the root's label. Paths are in lexical order.
+// If the filesystem is a directory on disk, its path is used to handle symlinks.
+func (res *fileSet) walkFS(ctx context.Context, fsys fs.FS, osPath, label string, f *Filter) error {
+	symlinks := res.t.Symlinks
+	if len(osPath) == 0 || len(symlinks) == 0 {
+		symlinks = SymlinksSkip
+	}
+
+	var walkFn fs.WalkDirFunc
+	walkFn = func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if d == nil {
+				// The root itself can't be read
+				return err
+			}
+			if err := res.fileError(joinLabel(label, path), err); err != nil {
+				return err
+			}
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if f.Skip(path, d.IsDir()) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		name := joinLabel(label, path)
+		if d.IsDir() {
+			res.dirPaths = append(res.dirPaths, name)
+			return nil
+		}
+		if d.Type()&fs.ModeSymlink != 0 && symlinks != SymlinksSkip {
+			fsPath := filepath.Join(osPath, path)
+			if symlinks == SymlinksRecord {
+				target, err := os.Readlink(fsPath)
+				if err != nil {
+					return res.fileError(name, err)
+				}
+				fi, err := os.Lstat(fsPath)
+				if err != nil {
+					return res.fileError(name, err)
+				}
+				res.addFile(name, int64(len(target)), fi)
+				return nil
+			}
+
+			// Follow the link
+			target, err := filepath.EvalSymlinks(fsPath)
+			if err != nil {
+				fmt.Fprintf(res.log, "Ignoring broken symlink: %s\n", name)
+				return nil
+			}
+			fi, err := os.Stat(target)
+			if err != nil {
+				return res.fileError(name, err)
+			}
+			if fi.IsDir() {
+				loop, err := onWalkStack(osPath, path, target)
+				if err != nil {
+					return err
+				}
+				if loop {
+					fmt.Fprintf(res.log, "Ignoring symlink loop: %s\n", name)
+					return nil
+				}
+				return fs.WalkDir(fsys, path, walkFn)
+			}
+			if fi.Mode().IsRegular() {
+				res.addFile(name, fi.Size(), fi)
+				return nil
+			}
+		}
+		if d.Type()&fs.ModeSymlink != 0 && symlinks == SymlinksSkip {
+			fmt.Fprintf(res.log, "Skipping symlink: %s\n", name)
+			res.skipped++
+			return nil
+		}
+		if d.Type() != 0 {
+			// Some sort of special file
+			fmt.Fprintf(res.log, "Ignoring special file: %s\n", name)
+			res.ignored++
+			return nil
+		}
+		if res.t.ExpandArchives && isArchive(name) {
+			return res.walkArchive(ctx, name, func(member string, isDir bool) bool {
+				return f.Skip(path+archiveSep+member, isDir)
+			})
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return res.fileError(name, err)
+		}
+		res.addFile(name, fi.Size(), fi)
+		return nil
+	}
+	return fs.WalkDir(fsys, ".", walkFn)
+}
+
+// onWalkStack reports whether following a link at name to the target
+// directory would loop forever. That happens if the target is one of the
+// directories the walk is inside of to reach name, or contains one of them.
+// Those are compared by their real paths, since they can be links that were
+// followed too, like two directories that link to each other.
+func onWalkStack(osPath, name, target string) (bool, error) {
+	for dir := filepath.FromSlash(name); dir != "."; {
+		dir = filepath.Dir(dir)
+		realDir, err := filepath.EvalSymlinks(filepath.Join(osPath, dir))
+		if err != nil {
+			return false, err
+		}
+		if rel, err := filepath.Rel(target, realDir); err == nil && !strings.HasPrefix(rel, "..") {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// walkArchive adds the members of an archive, as if it was a directory named
+// with a trailing "!". The skip function can be nil. Archives or members that
+// can't be read are handled like other files, see fileError.
+func (res *fileSet) walkArchive(ctx context.Context, name string, skip func(member string, isDir bool) bool) error {
+	fsys, err := res.archive(name)
+	if err != nil {
+		return res.fileError(name, fmt.Errorf("error opening archive %s: %w", name, err))
+	}
+	return fs.WalkDir(fsys, ".", func(member string, d fs.DirEntry, err error) error {
+		if err != nil {
+			errName := name
+			if member != "." {
+				errName = name + archiveSep + member
+			}
+			if err := res.fileError(errName, err); err != nil {
+				return err
+			}
+			if d != nil && d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if skip != nil && member != "." && skip(member, d.IsDir()) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if member == "." {
+			res.dirPaths = append(res.dirPaths, name+"!")
+			return nil
+		}
+		memberName := name + archiveSep + member
+		if d.IsDir() {
+			res.dirPaths = append(res.dirPaths, memberName)
+			return nil
+		}
+		if d.Type()&fs.ModeSymlink != 0 {
+			// Links in archives can't be followed or recorded
+			fmt.Fprintf(res.log, "Skipping symlink: %s\n", memberName)
+			res.skipped++
+			return nil
+		}
+		if d.Type() != 0 {
+			fmt.Fprintf(res.log, "Ignoring special file: %s\n", memberName)
+			res.ignored++
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return res.fileError(memberName, err)
+		}
+		res.addFile(memberName, fi.Size(), fi)
+		return nil
+	})
+}
+
+// root returns the filesystem for the root with the given label, opening it if needed.
+func (res *fileSet) root(label string) (fs.FS, error) {
+	res.mu.Lock()
+	defer res.mu.Unlock()
+	if fsys, ok := res.rootFS[label]; ok {
+		return fsys, nil
+	}
+	_, roots := res.t.roots()
+	r, ok := roots[label]
+	if !ok {
+		return nil, fmt.Errorf("no root with label %s in tree", label)
+	}
+	if !r.Archive {
+		dir := r.Path
+		if len(dir) == 0 {
+			// Extracted trees don't store one, see Tree.Extract
+			dir = "."
+		}
+		res.rootFS[label] = os.DirFS(dir)
+		return res.rootFS[label], nil
+	}
+	fsys, err := openArchive(os.DirFS(filepath.Dir(r.Path)), filepath.Base(r.Path))
+	if err != nil {
+		return nil, fmt.Errorf("error opening archive %s: %w", r.Path, err)
+	}
+	res.archives["\x00"+label] = fsys // Not a valid name, so it won't collide
+	res.rootFS[label] = fsys
+	return fsys, nil
+}
+
+// locate returns the filesystem the named file is in, and its path there.
+func (res *fileSet) locate(name string) (fs.FS, string, error) {
+	if len(res.t.Roots) == 0 {
+		fsys, err := res.root("")
+		return fsys, name, err
+	}
+	label, rest, _ := strings.Cut(name, "/")
+	r, ok := res.t.Roots[label]
+	if !ok {
+		return nil, "", fmt.Errorf("file is not part of any root in the tree")
+	}
+	if len(rest) == 0 && !r.Archive {
+		// The root is a single file
+		return os.DirFS(filepath.Dir(r.Path)), filepath.Base(r.Path), nil
+	}
+	fsys, err := res.root(label)
+	return fsys, rest, err
+}
+
+// archive returns the named archive in the tree, opening it if needed.
+func (res *fileSet) archive(name string) (archiveFS, error) {
+	res.mu.Lock()
+	fsys, ok := res.archives[name]
+	res.mu.Unlock()
+	if ok {
+		return fsys, nil
+	}
+
+	parent, p, err := res.locate(name)
+	if err != nil {
+		return nil, err
+	}
+	fsys, err = openArchive(parent, p)
+	if err != nil {
+		return nil, err
+	}
+	res.mu.Lock()
+	defer res.mu.Unlock()
+	if existing, ok := res.archives[name]; ok {
+		// Opened concurrently
+		fsys.Close()
+		return existing, nil
+	}
+	res.archives[name] = fsys
+	return fsys, nil
+}
+
+// isArchive reports whether the named file in the tree is an archive. Roots
+// that are single files are named by their label, so the path on disk is used.
+func (res *fileSet) isArchive(name string) bool {
+	if r, ok := res.t.Roots[name]; ok && !r.Archive {
+		return isArchive(r.Path)
+	}
+	return isArchive(name)
+}
+
+// open opens the named file in the tree for reading. Archive members and
+// recorded symlinks are handled the same way as when the tree was generated.
+func (res *fileSet) open(name string) (io.ReadCloser, error) {
+	if archiveName, member, ok := splitArchive(name, res.isArchive); ok && res.t.ExpandArchives {
+		fsys, err := res.archive(archiveName)
+		if err != nil {
+			return nil, err
+		}
+		return fsys.Open(member)
+	}
+	fsys, p, err := res.locate(name)
+	if err != nil {
+		return nil, err
+	}
+	if res.t.Symlinks == SymlinksRecord && !res.custom {
+		fsPath, err := res.t.fsPath(name)
+		if err != nil {
+			return nil, err
+		}
+		// Archive members won't be found on disk, so they are opened normally
+		if fi, err := os.Lstat(fsPath); err == nil && fi.Mode()&fs.ModeSymlink != 0 {
+			target, err := os.Readlink(fsPath)
+			if err != nil {
+				return nil, err
+			}
+			return io.NopCloser(strings.NewReader(target)), nil
+		}
+	}
+	return fsys.Open(p)
+}
+
+// close closes any archives that were opened.
+func (res *fileSet) close() error {
+	res.mu.Lock()
+	defer res.mu.Unlock()
+	var firstErr error
+	for name, fsys := range res.archives {
+		if err := fsys.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(res.archives, name)
+	}
+	return firstErr
+}